@@ -0,0 +1,52 @@
+package morm
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mgoDatabase is the part of *mongo.Database used by mgoModelImpl. It lets
+// the same model run on the driver or on the in-memory backend.
+type mgoDatabase interface {
+	Collection(name string) mgoCollection
+	ListCollectionNames(ctx context.Context, filter interface{}, opts ...*options.ListCollectionsOptions) ([]string, error)
+	CreateCollection(ctx context.Context, name string, opts ...*options.CreateCollectionOptions) error
+	CreateIndexes(ctx context.Context, name string, models []mongo.IndexModel) error
+}
+
+// mgoCollection is the part of *mongo.Collection used by mgoModelImpl.
+type mgoCollection interface {
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+}
+
+func newDriverDatabase(db *mongo.Database) mgoDatabase {
+	if db == nil {
+		return nil
+	}
+	return &driverDatabase{Database: db}
+}
+
+type driverDatabase struct {
+	*mongo.Database
+}
+
+func (db *driverDatabase) Collection(name string) mgoCollection {
+	return db.Database.Collection(name)
+}
+
+func (db *driverDatabase) CreateIndexes(ctx context.Context, name string, models []mongo.IndexModel) error {
+	_, err := db.Database.Collection(name).Indexes().CreateMany(ctx, models)
+	return err
+}
@@ -0,0 +1,92 @@
+package morm
+
+import (
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// toBsonD normalizes any document (struct, bson.M, bson.D...) into a bson.D
+// whose nested documents are primitive.D and arrays are primitive.A.
+func toBsonD(v interface{}) (bson.D, error) {
+	if v == nil {
+		return bson.D{}, nil
+	}
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err = bson.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// normalizeValue converts a single value the same way toBsonD does.
+func normalizeValue(v interface{}) (interface{}, error) {
+	d, err := toBsonD(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return nil, err
+	}
+	return d[0].Value, nil
+}
+
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case primitive.D:
+		return copyDoc(t)
+	case primitive.A:
+		a := make(primitive.A, len(t))
+		for i := range t {
+			a[i] = copyValue(t[i])
+		}
+		return a
+	default:
+		return v
+	}
+}
+
+func copyDoc(d bson.D) bson.D {
+	c := make(bson.D, len(d))
+	for i, e := range d {
+		c[i] = primitive.E{Key: e.Key, Value: copyValue(e.Value)}
+	}
+	return c
+}
+
+func docGet(d bson.D, key string) (interface{}, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// lookupPath returns the value at a dotted path without expanding arrays,
+// numeric parts index into arrays.
+func lookupPath(d bson.D, path string) (interface{}, bool) {
+	var cur interface{} = d
+	for _, p := range strings.Split(path, ".") {
+		switch t := cur.(type) {
+		case primitive.D:
+			v, ok := docGet(t, p)
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case primitive.A:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			cur = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
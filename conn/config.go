@@ -2,14 +2,18 @@ package conn
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 type MongoDI interface {
@@ -20,13 +24,57 @@ type MongoDI interface {
 	GetDb() string
 }
 
+// MongoConf is loaded from YAML, JSON or the environment, see
+// LoadMongoConf and LoadEnv. Options left zero keep the driver defaults,
+// timeouts are in milliseconds as in the uri options.
 type MongoConf struct {
-	Uri       string `yaml:"uri"`
-	User      string `yaml:"user"`
-	Pass      string `yaml:"pass"`
-	DefaultDB string `yaml:"defaul"`
+	Uri       string `yaml:"uri" json:"uri" env:"URI"`
+	User      string `yaml:"user" json:"user" env:"USER"`
+	Pass      string `yaml:"pass" json:"pass" env:"PASS"`
+	DefaultDB string `yaml:"default" json:"default" env:"DEFAULT_DB"`
+
+	AppName                  string `yaml:"appName" json:"appName" env:"APP_NAME"`
+	MinPoolSize              uint64 `yaml:"minPoolSize" json:"minPoolSize" env:"MIN_POOL_SIZE"`
+	MaxPoolSize              uint64 `yaml:"maxPoolSize" json:"maxPoolSize" env:"MAX_POOL_SIZE"`
+	MaxIdleTimeMS            int64  `yaml:"maxIdleTimeMS" json:"maxIdleTimeMS" env:"MAX_IDLE_TIME_MS"`
+	ConnectTimeoutMS         int64  `yaml:"connectTimeoutMS" json:"connectTimeoutMS" env:"CONNECT_TIMEOUT_MS"`
+	ServerSelectionTimeoutMS int64  `yaml:"serverSelectionTimeoutMS" json:"serverSelectionTimeoutMS" env:"SERVER_SELECTION_TIMEOUT_MS"`
+	SocketTimeoutMS          int64  `yaml:"socketTimeoutMS" json:"socketTimeoutMS" env:"SOCKET_TIMEOUT_MS"`
+
+	// TLSCertFile holds the client certificate, with its key unless
+	// TLSKeyFile is set. Any of the files turns TLS on.
+	TLS         bool   `yaml:"tls" json:"tls" env:"TLS"`
+	TLSCAFile   string `yaml:"tlsCAFile" json:"tlsCAFile" env:"TLS_CA_FILE"`
+	TLSCertFile string `yaml:"tlsCertFile" json:"tlsCertFile" env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `yaml:"tlsKeyFile" json:"tlsKeyFile" env:"TLS_KEY_FILE"`
+
+	// Compressors of snappy, zlib and zstd in order of preference.
+	Compressors []string `yaml:"compressors" json:"compressors" env:"COMPRESSORS"`
+	// ReadPreference is a mode like primary or secondaryPreferred.
+	ReadPreference string `yaml:"readPreference" json:"readPreference" env:"READ_PREFERENCE"`
+	// ReadConcern is a level: local, available, majority, linearizable or
+	// snapshot.
+	ReadConcern string `yaml:"readConcern" json:"readConcern" env:"READ_CONCERN"`
+	// WriteConcern is majority, a number of nodes or a tag set name.
+	WriteConcern string `yaml:"writeConcern" json:"writeConcern" env:"WRITE_CONCERN"`
+	Journal      *bool  `yaml:"journal" json:"journal" env:"JOURNAL"`
+	RetryWrites  *bool  `yaml:"retryWrites" json:"retryWrites" env:"RETRY_WRITES"`
+	RetryReads   *bool  `yaml:"retryReads" json:"retryReads" env:"RETRY_READS"`
 
 	authUri string
+	manager *ClientManager
+	// managerOpts are built once so every call shares them with cm
+	managerOpts    *options.ClientOptions
+	managerOptsErr error
+}
+
+// UseClientManager makes NewDbConn hand out handles on the clients of cm
+// instead of connecting a new client per call. The options of the conf
+// are read once, by this call, and confs sharing a uri need the same
+// options, see ClientManager.Conn.
+func (mc *MongoConf) UseClientManager(cm *ClientManager) {
+	mc.manager = cm
+	mc.managerOpts, mc.managerOptsErr = mc.ClientOptions()
 }
 
 func (mc *MongoConf) SetAuth(user, pwd string) {
@@ -61,14 +109,19 @@ func (mc *MongoConf) NewDbConn(ctx context.Context, db string) (MongoDBConn, err
 		return nil, errors.New("db is empty")
 	}
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetConnectTimeout(10*time.Second))
+	if mc.manager != nil {
+		if mc.managerOptsErr != nil {
+			return nil, mc.managerOptsErr
+		}
+		return mc.manager.Conn(ctx, uri, db, mc.managerOpts)
+	}
+	opts, err := mc.ClientOptions()
 	if err != nil {
-		return nil, fmt.Errorf("connect error: %w", err)
+		return nil, err
 	}
-
-	err = client.Ping(ctx, readpref.Primary())
+	client, err := connectClient(ctx, uri, opts)
 	if err != nil {
-		return nil, fmt.Errorf("ping fail: %w", err)
+		return nil, err
 	}
 
 	dbclt := client.Database(db)
@@ -78,3 +131,101 @@ func (mc *MongoConf) NewDbConn(ctx context.Context, db string) (MongoDBConn, err
 		db:  dbclt,
 	}, nil
 }
+
+// ClientOptions returns the driver options of the conf, applied after the
+// uri so they override its query options.
+func (mc *MongoConf) ClientOptions() (*options.ClientOptions, error) {
+	opts := options.Client()
+	if mc.AppName != "" {
+		opts.SetAppName(mc.AppName)
+	}
+	if mc.MinPoolSize > 0 {
+		opts.SetMinPoolSize(mc.MinPoolSize)
+	}
+	if mc.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(mc.MaxPoolSize)
+	}
+	if mc.MaxIdleTimeMS > 0 {
+		opts.SetMaxConnIdleTime(millis(mc.MaxIdleTimeMS))
+	}
+	if mc.ConnectTimeoutMS > 0 {
+		opts.SetConnectTimeout(millis(mc.ConnectTimeoutMS))
+	}
+	if mc.ServerSelectionTimeoutMS > 0 {
+		opts.SetServerSelectionTimeout(millis(mc.ServerSelectionTimeoutMS))
+	}
+	if mc.SocketTimeoutMS > 0 {
+		opts.SetSocketTimeout(millis(mc.SocketTimeoutMS))
+	}
+	if len(mc.Compressors) > 0 {
+		opts.SetCompressors(mc.Compressors)
+	}
+	if mc.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(mc.ReadPreference)
+		if err != nil {
+			return nil, err
+		}
+		rp, err := readpref.New(mode)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetReadPreference(rp)
+	}
+	if mc.ReadConcern != "" {
+		opts.SetReadConcern(&readconcern.ReadConcern{Level: mc.ReadConcern})
+	}
+	if mc.WriteConcern != "" || mc.Journal != nil {
+		wc := &writeconcern.WriteConcern{Journal: mc.Journal}
+		if n, err := strconv.Atoi(mc.WriteConcern); err == nil {
+			wc.W = n
+		} else if mc.WriteConcern != "" {
+			wc.W = mc.WriteConcern
+		}
+		opts.SetWriteConcern(wc)
+	}
+	if mc.RetryWrites != nil {
+		opts.SetRetryWrites(*mc.RetryWrites)
+	}
+	if mc.RetryReads != nil {
+		opts.SetRetryReads(*mc.RetryReads)
+	}
+	if mc.TLS || mc.TLSCAFile != "" || mc.TLSCertFile != "" {
+		tlsConf, err := mc.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConf)
+	}
+	return opts, nil
+}
+
+func (mc *MongoConf) tlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if mc.TLSCAFile != "" {
+		pem, err := os.ReadFile(mc.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate in " + mc.TLSCAFile)
+		}
+		conf.RootCAs = pool
+	}
+	if mc.TLSCertFile != "" {
+		keyFile := mc.TLSKeyFile
+		if keyFile == "" {
+			keyFile = mc.TLSCertFile
+		}
+		cert, err := tls.LoadX509KeyPair(mc.TLSCertFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func millis(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,206 @@
+package conn
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadMongoConf reads a conf from a .json file, any other file is read as
+// YAML.
+func LoadMongoConf(path string) (*MongoConf, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mc := &MongoConf{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(b, mc)
+	default:
+		err = yaml.Unmarshal(b, mc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return mc, nil
+}
+
+// UnmarshalYAML still reads the default db from the old misspelled
+// "defaul" key.
+func (mc *MongoConf) UnmarshalYAML(value *yaml.Node) error {
+	type plain MongoConf
+	if err := value.Decode((*plain)(mc)); err != nil {
+		return err
+	}
+	if mc.DefaultDB == "" {
+		var legacy struct {
+			DefaultDB string `yaml:"defaul"`
+		}
+		if err := value.Decode(&legacy); err != nil {
+			return err
+		}
+		mc.DefaultDB = legacy.DefaultDB
+	}
+	return nil
+}
+
+const defaultEnvPrefix = "MONGO_"
+
+// LoadEnv overrides the fields whose variable is set, the env tag of the
+// field after prefix, e.g. MONGO_MAX_POOL_SIZE for prefix "MONGO_".
+// Compressors are comma separated. An empty prefix means "MONGO_" so that
+// USER or PASS of the shell are not picked up.
+func (mc *MongoConf) LoadEnv(prefix string) error {
+	if prefix == "" {
+		prefix = defaultEnvPrefix
+	}
+	v := reflect.ValueOf(mc).Elem()
+	t := v.Type()
+	var problems []string
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := t.Field(i).Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+		name = prefix + name
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvField(v.Field(i), s); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return &ConfError{Problems: problems}
+	}
+	return nil
+}
+
+func setEnvField(f reflect.Value, s string) error {
+	switch f.Interface().(type) {
+	case string:
+		f.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.Set(reflect.ValueOf(&b))
+	case int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case []string:
+		var list []string
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				list = append(list, p)
+			}
+		}
+		f.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// ConfError lists every problem found in a conf.
+type ConfError struct {
+	Problems []string
+}
+
+func (e *ConfError) Error() string {
+	return "invalid mongo conf: " + strings.Join(e.Problems, "; ")
+}
+
+var (
+	mongoCompressors = map[string]bool{"snappy": true, "zlib": true, "zstd": true}
+	readConcerns     = map[string]bool{
+		"local": true, "available": true, "majority": true, "linearizable": true, "snapshot": true,
+	}
+)
+
+// Validate checks the conf without connecting, returning a *ConfError with
+// all of its problems.
+func (mc *MongoConf) Validate() error {
+	var problems []string
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+	if mc.Uri == "" {
+		add("uri not set")
+	} else if !strings.HasPrefix(mc.Uri, "mongodb://") && !strings.HasPrefix(mc.Uri, "mongodb+srv://") {
+		add("uri must start with mongodb:// or mongodb+srv://")
+	}
+	if mc.MaxPoolSize > 0 && mc.MinPoolSize > mc.MaxPoolSize {
+		add("minPoolSize %d greater than maxPoolSize %d", mc.MinPoolSize, mc.MaxPoolSize)
+	}
+	timeouts := []struct {
+		name string
+		ms   int64
+	}{
+		{"maxIdleTimeMS", mc.MaxIdleTimeMS},
+		{"connectTimeoutMS", mc.ConnectTimeoutMS},
+		{"serverSelectionTimeoutMS", mc.ServerSelectionTimeoutMS},
+		{"socketTimeoutMS", mc.SocketTimeoutMS},
+	}
+	for _, t := range timeouts {
+		if t.ms < 0 {
+			add("%s is negative", t.name)
+		}
+	}
+	for _, file := range []string{mc.TLSCAFile, mc.TLSCertFile, mc.TLSKeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			add("%v", err)
+		}
+	}
+	if mc.TLSKeyFile != "" && mc.TLSCertFile == "" {
+		add("tlsKeyFile set without tlsCertFile")
+	}
+	for _, c := range mc.Compressors {
+		if !mongoCompressors[c] {
+			add("unknown compressor %q", c)
+		}
+	}
+	if mc.ReadPreference != "" {
+		if _, err := readpref.ModeFromString(mc.ReadPreference); err != nil {
+			add("%v", err)
+		}
+	}
+	if mc.ReadConcern != "" && !readConcerns[mc.ReadConcern] {
+		add("unknown read concern %q", mc.ReadConcern)
+	}
+	if n, err := strconv.Atoi(mc.WriteConcern); err == nil && n < 0 {
+		add("write concern can not be negative")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ConfError{Problems: problems}
+}
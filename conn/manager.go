@@ -0,0 +1,202 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+var (
+	ErrManagerClosed   = errors.New("client manager closed")
+	ErrOptionsMismatch = errors.New("client of uri is shared with other options")
+)
+
+// ClientManager keeps one pooled mongo.Client per uri. Conn hands out
+// handles sharing that client, closing a handle only releases it and
+// clients are disconnected by Close.
+type ClientManager struct {
+	lock    sync.Mutex
+	clients map[string]*managedClient
+	closed  bool
+}
+
+type managedClient struct {
+	opts  []*options.ClientOptions
+	ready chan struct{}
+	clt   *mongo.Client
+	err   error
+	refs  int
+}
+
+func NewClientManager() *ClientManager {
+	return &ClientManager{
+		clients: map[string]*managedClient{},
+	}
+}
+
+// Conn returns a handle on db. The client of uri is connected and pinged
+// on first use with opts applied after the uri, apart from ctx so that a
+// cancelled first caller does not fail the others. ctx only bounds the
+// wait. Later callers must pass equal opts or get ErrOptionsMismatch,
+// options holding funcs such as monitors only equal when those are nil.
+func (cm *ClientManager) Conn(ctx context.Context, uri, db string, opts ...*options.ClientOptions) (MongoDBConn, error) {
+	if uri == "" {
+		return nil, errors.New("mongo uri not set")
+	}
+	if db == "" {
+		return nil, errors.New("db is empty")
+	}
+	cm.lock.Lock()
+	if cm.closed {
+		cm.lock.Unlock()
+		return nil, ErrManagerClosed
+	}
+	mc, ok := cm.clients[uri]
+	if ok && !sameOptions(mc.opts, opts) {
+		cm.lock.Unlock()
+		return nil, ErrOptionsMismatch
+	}
+	if !ok {
+		mc = &managedClient{opts: opts, ready: make(chan struct{})}
+		cm.clients[uri] = mc
+	}
+	mc.refs++
+	cm.lock.Unlock()
+
+	if !ok {
+		go func() {
+			mc.clt, mc.err = connectClient(context.Background(), uri, opts...)
+			close(mc.ready)
+		}()
+	}
+	select {
+	case <-mc.ready:
+	case <-ctx.Done():
+		cm.release(uri, mc)
+		return nil, ctx.Err()
+	}
+	if mc.err != nil {
+		cm.release(uri, mc)
+		return nil, mc.err
+	}
+	var once sync.Once
+	return &mgoClientImpl{
+		ctx: ctx,
+		clt: mc.clt,
+		db:  mc.clt.Database(db),
+		release: func() {
+			once.Do(func() {
+				cm.release(uri, mc)
+			})
+		},
+	}, nil
+}
+
+// release drops a reference, forgetting clients that failed to connect so
+// the next Conn tries again.
+func (cm *ClientManager) release(uri string, mc *managedClient) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	mc.refs--
+	select {
+	case <-mc.ready:
+		if mc.err != nil && cm.clients[uri] == mc {
+			delete(cm.clients, uri)
+		}
+	default:
+	}
+}
+
+// Refs returns the number of open handles on the client of uri.
+func (cm *ClientManager) Refs(uri string) int {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if mc, ok := cm.clients[uri]; ok {
+		return mc.refs
+	}
+	return 0
+}
+
+// Close disconnects every client, handles still open stop working. It goes
+// through all of them and returns the first error. Clients still connecting
+// when ctx is done are disconnected once connected.
+func (cm *ClientManager) Close(ctx context.Context) error {
+	cm.lock.Lock()
+	cm.closed = true
+	clients := cm.clients
+	cm.clients = map[string]*managedClient{}
+	cm.lock.Unlock()
+
+	var firstErr error
+	for _, mc := range clients {
+		var err error
+		select {
+		case <-mc.ready:
+			if mc.clt != nil {
+				err = mc.clt.Disconnect(ctx)
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+			go func(mc *managedClient) {
+				<-mc.ready
+				if mc.clt != nil {
+					mc.clt.Disconnect(context.Background())
+				}
+			}(mc)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func sameOptions(a, b []*options.ClientOptions) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// connectClient bounds ctx by the connect and server selection timeouts
+// of the options.
+func connectClient(ctx context.Context, uri string, opts ...*options.ClientOptions) (*mongo.Client, error) {
+	clientOpts := append([]*options.ClientOptions{
+		options.Client().ApplyURI(uri).SetConnectTimeout(10 * time.Second),
+	}, opts...)
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout(clientOpts))
+	defer cancel()
+	client, err := mongo.Connect(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("connect error: %w", err)
+	}
+	err = client.Ping(ctx, readpref.Primary())
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("ping fail: %w", err)
+	}
+	return client, nil
+}
+
+func connectTimeout(opts []*options.ClientOptions) time.Duration {
+	connect, selection := 10*time.Second, 30*time.Second
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.ConnectTimeout != nil {
+			connect = *o.ConnectTimeout
+		}
+		if o.ServerSelectionTimeout != nil {
+			selection = *o.ServerSelectionTimeout
+		}
+	}
+	return connect + selection
+}
@@ -0,0 +1,243 @@
+package conn
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MiddlewareOptions struct {
+	// DB is the database of the connections, the default db of the
+	// MongoDI when empty.
+	DB string
+	// Transaction wraps the handler in a transaction, committed when the
+	// response status is 2xx and aborted otherwise. The request context is
+	// bound to it so the models of NewMgoModelByReq run inside.
+	//
+	// The status and body written by the handler are held until the
+	// transaction ends, failing to end it drops them for the response of
+	// ErrorHandler, a 503 by default. Responses are not streamed.
+	Transaction bool
+	TxOptions   *options.TransactionOptions
+	// ErrorHandler writes the response for the errors opening the
+	// connection, or beginning and ending the transaction. By default a 503
+	// is written when nothing was yet.
+	ErrorHandler func(w http.ResponseWriter, req *http.Request, err error)
+}
+
+func (o MiddlewareOptions) conn(ctx context.Context, di MongoDI) (MongoDBConn, error) {
+	if o.DB == "" {
+		return di.NewDefaultDbConn(ctx)
+	}
+	return di.NewDbConn(ctx, o.DB)
+}
+
+// begin stores clt in ctx and starts the transaction when enabled, tx is
+// nil otherwise.
+func (o MiddlewareOptions) begin(ctx context.Context, clt MongoDBConn) (context.Context, Tx, error) {
+	ctx = SetMgoDbConnToCtx(ctx, clt)
+	if !o.Transaction {
+		return ctx, nil, nil
+	}
+	var txOpts []*options.TransactionOptions
+	if o.TxOptions != nil {
+		txOpts = append(txOpts, o.TxOptions)
+	}
+	tx, err := clt.BeginTx(ctx, txOpts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx.Context(), tx, nil
+}
+
+func (o MiddlewareOptions) fail(w http.ResponseWriter, req *http.Request, written bool, err error) {
+	if o.ErrorHandler != nil {
+		o.ErrorHandler(w, req, err)
+		return
+	}
+	if !written {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	}
+}
+
+// dropResponse clears the headers the handler set before the error
+// response replaces its held one.
+func dropResponse(w http.ResponseWriter) {
+	h := w.Header()
+	for k := range h {
+		delete(h, k)
+	}
+}
+
+func endTx(tx Tx, status int) error {
+	if status >= 200 && status < 300 {
+		return tx.Commit()
+	}
+	return tx.Abort()
+}
+
+// HTTPMiddleware opens a connection from di for each request, sets it to
+// the request and closes it once the handler returns. Closing aborts the
+// transaction left open by a panic.
+func HTTPMiddleware(di MongoDI, opts MiddlewareOptions) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			clt, err := opts.conn(req.Context(), di)
+			if err != nil {
+				opts.fail(w, req, false, err)
+				return
+			}
+			defer clt.Close()
+			ctx, tx, err := opts.begin(req.Context(), clt)
+			if err != nil {
+				opts.fail(w, req, false, err)
+				return
+			}
+			req = req.WithContext(ctx)
+			if tx == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			bw := &bufferWriter{ResponseWriter: w}
+			next.ServeHTTP(bw, req)
+			if err = endTx(tx, bw.held.Status()); err != nil {
+				dropResponse(w)
+				opts.fail(w, req, false, err)
+				return
+			}
+			bw.held.send(w)
+		})
+	}
+}
+
+// heldResponse is the status and body written by a handler, held until
+// the transaction ends.
+type heldResponse struct {
+	status int
+	body   bytes.Buffer
+}
+
+func (r *heldResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *heldResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *heldResponse) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// send writes the held response to w.
+func (r *heldResponse) send(w http.ResponseWriter) {
+	if r.status != 0 {
+		w.WriteHeader(r.status)
+	}
+	if r.body.Len() > 0 {
+		w.Write(r.body.Bytes())
+	}
+}
+
+// bufferWriter holds the response of a handler, headers go to the
+// ResponseWriter as they are set.
+type bufferWriter struct {
+	http.ResponseWriter
+	held heldResponse
+}
+
+func (w *bufferWriter) WriteHeader(status int) {
+	w.held.WriteHeader(status)
+}
+
+func (w *bufferWriter) Write(b []byte) (int, error) {
+	return w.held.Write(b)
+}
+
+// ginBufferWriter is bufferWriter for gin.
+type ginBufferWriter struct {
+	gin.ResponseWriter
+	held heldResponse
+}
+
+func (w *ginBufferWriter) WriteHeader(status int) {
+	w.held.WriteHeader(status)
+}
+
+func (w *ginBufferWriter) WriteHeaderNow() {
+}
+
+func (w *ginBufferWriter) Write(b []byte) (int, error) {
+	return w.held.Write(b)
+}
+
+func (w *ginBufferWriter) WriteString(s string) (int, error) {
+	return w.held.Write([]byte(s))
+}
+
+func (w *ginBufferWriter) Status() int {
+	return w.held.Status()
+}
+
+func (w *ginBufferWriter) Size() int {
+	return w.held.body.Len()
+}
+
+func (w *ginBufferWriter) Written() bool {
+	return w.held.status != 0
+}
+
+func (w *ginBufferWriter) Flush() {
+}
+
+// GinMiddleware is HTTPMiddleware for gin, the connection is also set to
+// the gin context. Failing to open it aborts the chain, errors ending the
+// transaction are also added to c.Errors.
+func GinMiddleware(di MongoDI, opts MiddlewareOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clt, err := opts.conn(c.Request.Context(), di)
+		if err != nil {
+			c.Abort()
+			opts.fail(c.Writer, c.Request, c.Writer.Written(), err)
+			return
+		}
+		defer clt.Close()
+		ctx, tx, err := opts.begin(c.Request.Context(), clt)
+		if err != nil {
+			c.Abort()
+			opts.fail(c.Writer, c.Request, c.Writer.Written(), err)
+			return
+		}
+		SetMgoDbConnToGin(c, clt)
+		c.Request = c.Request.WithContext(ctx)
+		if tx == nil {
+			c.Next()
+			return
+		}
+		w := c.Writer
+		bw := &ginBufferWriter{ResponseWriter: w}
+		c.Writer = bw
+		defer func() {
+			c.Writer = w
+		}()
+		c.Next()
+		if err = endTx(tx, bw.held.Status()); err != nil {
+			c.Error(err)
+			dropResponse(w)
+			opts.fail(w, c.Request, false, err)
+			return
+		}
+		bw.held.send(w)
+	}
+}
@@ -0,0 +1,221 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// recordingDI hands out lazy connections logging how their transactions
+// and themselves end.
+type recordingDI struct {
+	MongoConf
+	t   *testing.T
+	err error
+	// commitErr fails the commits
+	commitErr error
+	lock      sync.Mutex
+	log       []string
+}
+
+func (di *recordingDI) NewDefaultDbConn(ctx context.Context) (MongoDBConn, error) {
+	if di.err != nil {
+		return nil, di.err
+	}
+	return &recordingConn{mgoClientImpl: newLazyConn(di.t, ctx), di: di}, nil
+}
+
+func (di *recordingDI) record(event string) {
+	di.lock.Lock()
+	defer di.lock.Unlock()
+	di.log = append(di.log, event)
+}
+
+func (di *recordingDI) events() []string {
+	di.lock.Lock()
+	defer di.lock.Unlock()
+	events := di.log
+	di.log = nil
+	return events
+}
+
+type recordingConn struct {
+	*mgoClientImpl
+	di *recordingDI
+}
+
+func (c *recordingConn) BeginTx(ctx context.Context, opts ...*options.TransactionOptions) (Tx, error) {
+	tx, err := c.mgoClientImpl.BeginTx(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingTx{Tx: tx, di: c.di}, nil
+}
+
+func (c *recordingConn) Close() error {
+	c.di.record("close")
+	return c.mgoClientImpl.Close()
+}
+
+type recordingTx struct {
+	Tx
+	di *recordingDI
+}
+
+func (tx *recordingTx) Commit() error {
+	tx.di.record("commit")
+	if tx.di.commitErr != nil {
+		tx.Tx.Abort()
+		return tx.di.commitErr
+	}
+	return tx.Tx.Commit()
+}
+
+func (tx *recordingTx) Abort() error {
+	tx.di.record("abort")
+	return tx.Tx.Abort()
+}
+
+func testHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if GetMgoDbConnFromReq(req) == nil {
+			t.Error("connection not set to the request")
+		}
+		if mongo.SessionFromContext(req.Context()) == nil {
+			t.Error("request not bound to the transaction")
+		}
+		switch req.URL.Path {
+		case "/created":
+			w.Header().Set("Location", "/created/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("created"))
+		case "/fail":
+			http.Error(w, "fail", http.StatusBadRequest)
+		case "/panic":
+			panic("handler")
+		}
+	})
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+		events []string
+	}{
+		{"/ok", http.StatusOK, []string{"commit", "close"}},
+		{"/created", http.StatusCreated, []string{"commit", "close"}},
+		{"/fail", http.StatusBadRequest, []string{"abort", "close"}},
+	}
+	di := &recordingDI{t: t}
+	h := HTTPMiddleware(di, MiddlewareOptions{Transaction: true})(testHandler(t))
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, rec.Code, tt.status)
+		}
+		if events := di.events(); !reflect.DeepEqual(events, tt.events) {
+			t.Errorf("%s: %v, want %v", tt.path, events, tt.events)
+		}
+	}
+}
+
+func TestHTTPMiddlewarePanic(t *testing.T) {
+	di := &recordingDI{t: t}
+	h := HTTPMiddleware(di, MiddlewareOptions{Transaction: true})(testHandler(t))
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic not passed on")
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/panic", nil))
+	}()
+	if events := di.events(); !reflect.DeepEqual(events, []string{"close"}) {
+		t.Fatalf("%v, want the connection closed only", events)
+	}
+}
+
+func TestHTTPMiddlewareConnError(t *testing.T) {
+	di := &recordingDI{t: t, err: errors.New("down")}
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	})
+
+	rec := httptest.NewRecorder()
+	HTTPMiddleware(di, MiddlewareOptions{})(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if called || rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("called %v, status %d", called, rec.Code)
+	}
+
+	var got error
+	opts := MiddlewareOptions{ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+		got = err
+		w.WriteHeader(http.StatusInternalServerError)
+	}}
+	rec = httptest.NewRecorder()
+	HTTPMiddleware(di, opts)(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got != di.err || rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got %v, status %d", got, rec.Code)
+	}
+}
+
+func TestHTTPMiddlewareCommitError(t *testing.T) {
+	di := &recordingDI{t: t, commitErr: errors.New("commit")}
+	rec := httptest.NewRecorder()
+	HTTPMiddleware(di, MiddlewareOptions{Transaction: true})(testHandler(t)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/created", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Location") != "" || rec.Body.String() == "created" {
+		t.Fatalf("status %d, headers %v, body %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+	if events := di.events(); !reflect.DeepEqual(events, []string{"commit", "close"}) {
+		t.Fatalf("%v, want commit and close", events)
+	}
+}
+
+func TestGinMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	di := &recordingDI{t: t}
+	r := gin.New()
+	r.Use(GinMiddleware(di, MiddlewareOptions{Transaction: true}))
+	r.GET("/*path", func(c *gin.Context) {
+		if GetMgoDbConnFromGin(c) == nil {
+			t.Error("connection not set to the gin context")
+		}
+		testHandler(t).ServeHTTP(c.Writer, c.Request)
+	})
+	tests := []struct {
+		path   string
+		status int
+		events []string
+	}{
+		{"/created", http.StatusCreated, []string{"commit", "close"}},
+		{"/fail", http.StatusBadRequest, []string{"abort", "close"}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, rec.Code, tt.status)
+		}
+		if events := di.events(); !reflect.DeepEqual(events, tt.events) {
+			t.Errorf("%s: %v, want %v", tt.path, events, tt.events)
+		}
+	}
+
+	di.commitErr = errors.New("commit")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/created", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Location") != "" || rec.Body.String() == "created" {
+		t.Fatalf("status %d, headers %v, body %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+}
@@ -3,12 +3,14 @@ package conn
 import (
 	"context"
 	"net/http"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
@@ -21,6 +23,7 @@ const (
 
 type MongoDBConn interface {
 	GetDbConn() *mongo.Database
+	BeginTx(ctx context.Context, opts ...*options.TransactionOptions) (Tx, error)
 	WithSession(f func(sc mongo.SessionContext) error) error
 	AbortTransaction(sc mongo.SessionContext) error
 	CommitTransaction(sc mongo.SessionContext) error
@@ -61,72 +64,157 @@ func GetMgoDbConnFromGin(c *gin.Context) MongoDBConn {
 	return clt.(MongoDBConn)
 }
 
+// Tx is a transaction on a session of its own, independent of the other
+// transactions of the connection. Commit and Abort end the session.
+type Tx interface {
+	// Context binds the operations using it to the transaction.
+	Context() mongo.SessionContext
+	Commit() error
+	Abort() error
+}
+
 type mgoClientImpl struct {
-	ctx     context.Context
-	clt     *mongo.Client
-	db      *mongo.Database
-	session mongo.Session
+	ctx context.Context
+	// lock guards clt, db and sessions, Close may run while other
+	// goroutines use the connection
+	lock     sync.Mutex
+	clt      *mongo.Client
+	db       *mongo.Database
+	sessions map[mongo.Session]struct{}
+	// release is set on handles of a ClientManager, Close calls it instead
+	// of disconnecting the shared client
+	release func()
 }
 
-func (m *mgoClientImpl) WithSession(f func(sc mongo.SessionContext) error) error {
-	if m.session != nil {
-		return nil
+func (m *mgoClientImpl) BeginTx(ctx context.Context, opts ...*options.TransactionOptions) (Tx, error) {
+	if ctx == nil {
+		ctx = m.ctx
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.clt == nil {
+		return nil, errors.New("connection closed")
 	}
 	session, err := m.clt.StartSession()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err = session.StartTransaction(opts...); err != nil {
+		session.EndSession(ctx)
+		return nil, err
+	}
+	if m.sessions == nil {
+		m.sessions = map[mongo.Session]struct{}{}
 	}
-	if err := session.StartTransaction(); err != nil {
+	m.sessions[session] = struct{}{}
+	return &txImpl{
+		m:  m,
+		sc: mongo.NewSessionContext(ctx, session),
+	}, nil
+}
+
+// WithSession runs f in a new transaction on a session of its own, f ends
+// it with CommitTransaction or AbortTransaction on sc. It is aborted when f
+// returns an error. Calls used to return nil without running f while an
+// earlier session was open, now each one runs f.
+func (m *mgoClientImpl) WithSession(f func(sc mongo.SessionContext) error) error {
+	tx, err := m.BeginTx(m.ctx)
+	if err != nil {
 		return err
 	}
-	m.session = session
-	return mongo.WithSession(m.ctx, m.session, f)
+	if err = f(tx.Context()); err != nil {
+		// a no-op when f already ended the transaction
+		tx.Abort()
+	}
+	return err
+}
+
+func (m *mgoClientImpl) endSession(sc mongo.SessionContext) {
+	session := mongo.SessionFromContext(sc)
+	m.lock.Lock()
+	_, ok := m.sessions[session]
+	delete(m.sessions, session)
+	m.lock.Unlock()
+	if ok {
+		session.EndSession(context.Background())
+	}
+}
+
+type txImpl struct {
+	m  *mgoClientImpl
+	sc mongo.SessionContext
+}
+
+func (t *txImpl) Context() mongo.SessionContext {
+	return t.sc
+}
+
+func (t *txImpl) Commit() error {
+	defer t.m.endSession(t.sc)
+	return t.sc.CommitTransaction(t.sc)
+}
+
+func (t *txImpl) Abort() error {
+	defer t.m.endSession(t.sc)
+	return t.sc.AbortTransaction(t.sc)
 }
 
 func (m *mgoClientImpl) GetDBList() ([]string, error) {
-	return m.clt.ListDatabaseNames(m.ctx, bson.M{})
+	return m.client().ListDatabaseNames(m.ctx, bson.M{})
 }
 
+// Close ends the open sessions, aborting their transactions.
 func (m *mgoClientImpl) Close() error {
 	if m == nil {
 		return nil
 	}
-	if m.session != nil {
-		m.session.EndSession(m.ctx)
-		m.session = nil
+	m.lock.Lock()
+	clt, sessions, release := m.clt, m.sessions, m.release
+	m.clt, m.db, m.sessions, m.release = nil, nil, nil, nil
+	m.lock.Unlock()
+	for session := range sessions {
+		session.EndSession(m.ctx)
+	}
+	if release != nil {
+		release()
+		return nil
 	}
-	if m.clt != nil {
-		err := m.clt.Disconnect(m.ctx)
-		m.clt = nil
-		m.db = nil
-		if err != nil {
-			return err
-		}
+	if clt != nil {
+		return clt.Disconnect(m.ctx)
 	}
 	return nil
 }
 
+func (m *mgoClientImpl) client() *mongo.Client {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.clt
+}
+
 func (m *mgoClientImpl) Ping() error {
-	return m.clt.Ping(m.ctx, readpref.Primary())
+	return m.client().Ping(m.ctx, readpref.Primary())
 }
 
 func (m *mgoClientImpl) GetDbConn() *mongo.Database {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	return m.db
 }
 
+// AbortTransaction aborts the transaction of sc, a session context given
+// by WithSession.
 func (m *mgoClientImpl) AbortTransaction(sc mongo.SessionContext) error {
-	if m.session == nil {
+	if sc == nil {
 		return errors.New("session is nil")
 	}
-	err := m.session.AbortTransaction(sc)
-	m.session = nil
-	return err
+	defer m.endSession(sc)
+	return sc.AbortTransaction(sc)
 }
+
 func (m *mgoClientImpl) CommitTransaction(sc mongo.SessionContext) error {
-	if m.session == nil {
+	if sc == nil {
 		return errors.New("session is nil")
 	}
-	err := m.session.CommitTransaction(sc)
-	m.session = nil
-	return err
+	defer m.endSession(sc)
+	return sc.CommitTransaction(sc)
 }
@@ -0,0 +1,114 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newLazyConn returns a connection whose client never reaches a server,
+// transactions without operations commit and abort without one.
+func newLazyConn(t *testing.T, ctx context.Context) *mgoClientImpl {
+	t.Helper()
+	clt, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mgoClientImpl{ctx: ctx, clt: clt, db: clt.Database("test")}
+}
+
+func TestMongoDBConnConcurrentTx(t *testing.T) {
+	ctx := context.Background()
+	m := newLazyConn(t, ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tx, err := m.BeginTx(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			m.GetDbConn()
+			if i%2 == 0 {
+				err = tx.Commit()
+			} else {
+				err = tx.Abort()
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			err = m.WithSession(func(sc mongo.SessionContext) error {
+				return m.CommitTransaction(sc)
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(m.sessions); n != 0 {
+		t.Fatalf("%d sessions left open", n)
+	}
+}
+
+func TestMongoDBConnCloseDuringTx(t *testing.T) {
+	ctx := context.Background()
+	m := newLazyConn(t, ctx)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			tx, err := m.BeginTx(ctx)
+			if err != nil {
+				// closed before it began
+				return
+			}
+			// the session may be ended by Close, only the race matters
+			if i%2 == 0 {
+				tx.Commit()
+			} else {
+				tx.Abort()
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-start
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	close(start)
+	wg.Wait()
+	if _, err := m.BeginTx(ctx); err == nil {
+		t.Fatal("BeginTx after Close should fail")
+	}
+	if m.GetDbConn() != nil {
+		t.Fatal("db kept after Close")
+	}
+}
+
+func TestMongoDBConnWithSessionAbortsOnError(t *testing.T) {
+	m := newLazyConn(t, context.Background())
+	defer m.Close()
+	boom := errors.New("boom")
+	err := m.WithSession(func(sc mongo.SessionContext) error {
+		return boom
+	})
+	if err != boom {
+		t.Fatalf("got %v, want %v", err, boom)
+	}
+	if n := len(m.sessions); n != 0 {
+		t.Fatalf("%d sessions left open", n)
+	}
+}
@@ -0,0 +1,317 @@
+package morm
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Tagged CSV export reads columns from csv struct tags:
+//
+//	Name    string    `csv:"Name"`
+//	Created time.Time `csv:"Created,time=2006-01-02,tz=Asia/Taipei"`
+//	Price   float64   `csv:"Price,format=%.2f"`
+//	State   int       `csv:"State,enum=1:Active|2:Closed"`
+//	Tags    []string  `csv:"Tags,sep=|"`
+//	Addr    *Address  `csv:"Address"`
+//
+// Only tagged fields are exported, in declaration order. Struct fields
+// whose type has tagged fields become one column per nested field, named
+// "Address.City". Slices are joined with sep, ";" by default, slices of
+// structs column by column. Untagged embedded structs are flattened.
+// time accepts a layout or one of RFC3339, date and datetime.
+
+type csvColumn struct {
+	header string
+	path   []int
+	layout string
+	loc    *time.Location
+	format string
+	enum   map[string]string
+	sep    string
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	csvPlanCache sync.Map
+)
+
+type csvPlan struct {
+	columns []*csvColumn
+	err     error
+}
+
+func csvColumns(t reflect.Type) ([]*csvColumn, error) {
+	t = derefType(t)
+	if p, ok := csvPlanCache.Load(t); ok {
+		plan := p.(*csvPlan)
+		return plan.columns, plan.err
+	}
+	plan := &csvPlan{}
+	if t.Kind() != reflect.Struct {
+		plan.err = fmt.Errorf("csv export needs a struct, got %s", t)
+	} else {
+		plan.columns, plan.err = walkCSVFields(t, "", nil, map[reflect.Type]bool{})
+		if plan.err == nil && len(plan.columns) == 0 {
+			plan.err = fmt.Errorf("%s has no csv tags", t)
+		}
+	}
+	csvPlanCache.Store(t, plan)
+	return plan.columns, plan.err
+}
+
+func walkCSVFields(t reflect.Type, prefix string, path []int, visiting map[reflect.Type]bool) ([]*csvColumn, error) {
+	if visiting[t] {
+		return nil, nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	var columns []*csvColumn
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		fieldPath := append(append([]int{}, path...), i)
+		ft := elemStructType(f.Type)
+		tag, ok := f.Tag.Lookup("csv")
+		if !ok {
+			if f.Anonymous && ft != nil {
+				sub, err := walkCSVFields(ft, prefix, fieldPath, visiting)
+				if err != nil {
+					return nil, err
+				}
+				columns = append(columns, sub...)
+			}
+			continue
+		}
+		if tag == "-" {
+			continue
+		}
+		col, err := parseCSVTag(tag)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+		}
+		if col.header == "" {
+			col.header = f.Name
+		}
+		if ft != nil && hasCSVTags(ft, map[reflect.Type]bool{}) {
+			sub, err := walkCSVFields(ft, prefix+col.header+".", fieldPath, visiting)
+			if err != nil {
+				return nil, err
+			}
+			columns = append(columns, sub...)
+			continue
+		}
+		col.header = prefix + col.header
+		col.path = fieldPath
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
+
+// elemStructType returns the struct behind pointers and slices of t, nil
+// for other types and for time.Time.
+func elemStructType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType {
+		return nil
+	}
+	return t
+}
+
+func hasCSVTags(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if _, ok := f.Tag.Lookup("csv"); ok {
+			return true
+		}
+		if ft := elemStructType(f.Type); f.Anonymous && ft != nil && hasCSVTags(ft, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCSVTag(tag string) (*csvColumn, error) {
+	parts := strings.Split(tag, ",")
+	col := &csvColumn{header: parts[0], sep: ";"}
+	for _, o := range parts[1:] {
+		k, v, _ := strings.Cut(o, "=")
+		switch k {
+		case "time":
+			switch v {
+			case "RFC3339":
+				v = time.RFC3339
+			case "date":
+				v = "2006-01-02"
+			case "datetime":
+				v = "2006-01-02 15:04:05"
+			}
+			col.layout = v
+		case "tz":
+			loc, err := time.LoadLocation(v)
+			if err != nil {
+				return nil, err
+			}
+			col.loc = loc
+		case "format":
+			col.format = v
+		case "enum":
+			col.enum = map[string]string{}
+			for _, pair := range strings.Split(v, "|") {
+				value, label, ok := strings.Cut(pair, ":")
+				if !ok {
+					return nil, fmt.Errorf("invalid enum label: %s", pair)
+				}
+				col.enum[value] = label
+			}
+		case "sep":
+			col.sep = v
+		default:
+			return nil, fmt.Errorf("unknown csv tag option: %s", k)
+		}
+	}
+	return col, nil
+}
+
+func (c *csvColumn) value(root reflect.Value) string {
+	values := []reflect.Value{root}
+	for _, idx := range c.path {
+		var next []reflect.Value
+		for _, v := range expandValues(values) {
+			if v.Kind() == reflect.Struct {
+				next = append(next, v.Field(idx))
+			}
+		}
+		values = next
+	}
+	values = expandValues(values)
+	cells := make([]string, 0, len(values))
+	for _, v := range values {
+		cells = append(cells, c.formatValue(v))
+	}
+	return strings.Join(cells, c.sep)
+}
+
+// expandValues dereferences values and spreads slices into their
+// elements, dropping nils. []byte stays one value.
+func expandValues(values []reflect.Value) []reflect.Value {
+	var result []reflect.Value
+	for _, v := range values {
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				break
+			}
+			v = v.Elem()
+		}
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface:
+			continue
+		case reflect.Slice, reflect.Array:
+			if v.Type().Elem().Kind() == reflect.Uint8 {
+				result = append(result, v)
+				continue
+			}
+			elems := make([]reflect.Value, v.Len())
+			for i := range elems {
+				elems[i] = v.Index(i)
+			}
+			result = append(result, expandValues(elems)...)
+		default:
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (c *csvColumn) formatValue(v reflect.Value) string {
+	i := v.Interface()
+	switch t := i.(type) {
+	case time.Time:
+		if t.IsZero() {
+			return ""
+		}
+		if c.loc != nil {
+			t = t.In(c.loc)
+		}
+		layout := c.layout
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		return t.Format(layout)
+	case primitive.ObjectID:
+		return t.Hex()
+	case primitive.DateTime:
+		return (&csvColumn{layout: c.layout, loc: c.loc}).formatValue(reflect.ValueOf(t.Time()))
+	}
+	s := fmt.Sprint(i)
+	if label, ok := c.enum[s]; ok {
+		return label
+	}
+	if c.format != "" {
+		return fmt.Sprintf(c.format, i)
+	}
+	return s
+}
+
+// selectCSVColumns orders columns by names, all of them when names is empty.
+func selectCSVColumns(columns []*csvColumn, names []string) ([]*csvColumn, error) {
+	if len(names) == 0 {
+		return columns, nil
+	}
+	byHeader := make(map[string]*csvColumn, len(columns))
+	for _, c := range columns {
+		byHeader[c.header] = c
+	}
+	selected := make([]*csvColumn, len(names))
+	for i, n := range names {
+		c, ok := byHeader[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown csv column: %s", n)
+		}
+		selected[i] = c
+	}
+	return selected, nil
+}
+
+func exportTaggedCSV(run execFunc, doc interface{}, w io.Writer, names []string) error {
+	columns, err := csvColumns(reflect.TypeOf(doc))
+	if err != nil {
+		return err
+	}
+	if columns, err = selectCSVColumns(columns, names); err != nil {
+		return err
+	}
+	title := make([]string, len(columns))
+	for i, c := range columns {
+		title[i] = c.header
+	}
+	record := make([]string, len(columns))
+	return exportDelimited(run, w, ',', title, func(writer *csv.Writer, i interface{}) error {
+		v := reflect.ValueOf(i)
+		for j, c := range columns {
+			record[j] = c.value(v)
+		}
+		return writer.Write(record)
+	})
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
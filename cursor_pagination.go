@@ -0,0 +1,229 @@
+package morm
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/wayne011872/morm/format"
+)
+
+// GetCursorPaginationSource pages d by the keys of sort with _id as the
+// tiebreaker, so deep pages cost the same as the first one.
+func (mm *mgoModelImpl) GetCursorPaginationSource(d DocInter, q bson.M, sort bson.D) format.CursorPaginationSource {
+	return &cursorPaginationImpl{
+		mm:   mm,
+		doc:  d,
+		sort: withIDKey(sort),
+		fetch: func(seek bson.M, sort bson.D, limit int64) (*mongo.Cursor, error) {
+			filter := mm.liveFilter(d, q)
+			if seek != nil {
+				filter = bson.M{"$and": bson.A{filter, seek}}
+			}
+			return mm.db.Collection(d.GetC()).Find(mm.ctx, filter, options.Find().SetSort(sort).SetLimit(limit))
+		},
+	}
+}
+
+// GetPipeCursorPaginationSource is GetCursorPaginationSource for the output
+// of aggr, whose docs need an _id.
+func (mm *mgoModelImpl) GetPipeCursorPaginationSource(aggr MgoAggregate, q bson.M, sort bson.D, opts ...*options.AggregateOptions) format.CursorPaginationSource {
+	return &cursorPaginationImpl{
+		mm:   mm,
+		doc:  aggr,
+		sort: withIDKey(sort),
+		fetch: func(seek bson.M, sort bson.D, limit int64) (*mongo.Cursor, error) {
+			pl := aggr.GetPipeline(mm.liveFilter(aggr, q))
+			if seek != nil {
+				pl = append(pl, bson.D{{Key: "$match", Value: seek}})
+			}
+			pl = append(pl, bson.D{{Key: "$sort", Value: sort}}, bson.D{{Key: "$limit", Value: limit}})
+			return mm.db.Collection(aggr.GetC()).Aggregate(mm.ctx, pl, opts...)
+		},
+	}
+}
+
+type cursorPaginationImpl struct {
+	mm    *mgoModelImpl
+	doc   interface{}
+	sort  bson.D
+	fetch func(seek bson.M, sort bson.D, limit int64) (*mongo.Cursor, error)
+}
+
+type cursorToken struct {
+	Back bool   `bson:"b,omitempty"`
+	Keys bson.A `bson:"k"`
+}
+
+func (cp *cursorPaginationImpl) CursorData(limit int64, cursor string, f format.ObjToMapFunc) ([]map[string]interface{}, string, string, error) {
+	var token *cursorToken
+	if cursor != "" {
+		var err error
+		if token, err = cp.decodeToken(cursor); err != nil {
+			return nil, "", "", err
+		}
+	}
+	back := token != nil && token.Back
+	sort := cp.sort
+	if back {
+		sort = make(bson.D, len(cp.sort))
+		for i, e := range cp.sort {
+			sort[i] = bson.E{Key: e.Key, Value: -sortDir(e.Value)}
+		}
+	}
+	var seek bson.M
+	if token != nil {
+		seek = seekFilter(sort, token.Keys)
+	}
+	c, err := cp.fetch(seek, sort, limit+1)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer c.Close(cp.mm.ctx)
+	myType := reflect.TypeOf(cp.doc)
+	docs := reflect.MakeSlice(reflect.SliceOf(myType), 0, int(limit))
+	var keys []bson.A
+	for int64(len(keys)) < limit && c.Next(cp.mm.ctx) {
+		doc := reflect.New(myType.Elem())
+		if err = c.Decode(doc.Interface()); err != nil {
+			return nil, "", "", err
+		}
+		docs = reflect.Append(docs, doc)
+		keys = append(keys, sortKeys(c.Current, cp.sort))
+	}
+	more := c.Next(cp.mm.ctx)
+	if err = c.Err(); err != nil {
+		return nil, "", "", err
+	}
+	if back {
+		swap := reflect.Swapper(docs.Interface())
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+			swap(i, j)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, "", "", nil
+	}
+	if _, ok := cp.doc.(DocInter); ok {
+		if err = callAfterFindAll(docs.Interface()); err != nil {
+			return nil, "", "", err
+		}
+	}
+	var next, prev string
+	if more || back {
+		next = encodeToken(&cursorToken{Keys: keys[len(keys)-1]})
+	}
+	if (more && back) || (token != nil && !back) {
+		prev = encodeToken(&cursorToken{Back: true, Keys: keys[0]})
+	}
+	rows, l := format.DocToMap(docs.Interface(), f)
+	if l == 0 {
+		return nil, next, prev, nil
+	}
+	return rows.([]map[string]interface{}), next, prev, nil
+}
+
+func (cp *cursorPaginationImpl) decodeToken(cursor string) (*cursorToken, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, format.ErrInvalidCursor
+	}
+	token := &cursorToken{}
+	if err = bson.Unmarshal(raw, token); err != nil || len(token.Keys) != len(cp.sort) {
+		return nil, format.ErrInvalidCursor
+	}
+	return token, nil
+}
+
+func encodeToken(t *cursorToken) string {
+	raw, err := bson.Marshal(t)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func withIDKey(sort bson.D) bson.D {
+	dir := 1
+	for _, e := range sort {
+		if e.Key == "_id" {
+			return sort
+		}
+		dir = sortDir(e.Value)
+	}
+	result := make(bson.D, len(sort), len(sort)+1)
+	copy(result, sort)
+	return append(result, bson.E{Key: "_id", Value: dir})
+}
+
+func sortDir(v interface{}) int {
+	switch t := v.(type) {
+	case int:
+		if t < 0 {
+			return -1
+		}
+	case int32:
+		if t < 0 {
+			return -1
+		}
+	case int64:
+		if t < 0 {
+			return -1
+		}
+	case float64:
+		if t < 0 {
+			return -1
+		}
+	}
+	return 1
+}
+
+// seekFilter matches the docs after keys in sort order. Null and missing
+// keys sort before any value as on the server, while $gt and $lt never
+// match them so they get clauses of their own.
+func seekFilter(sort bson.D, keys bson.A) bson.M {
+	or := make(bson.A, 0, len(sort))
+	for i, e := range sort {
+		clause := bson.M{}
+		for j := 0; j < i; j++ {
+			clause[sort[j].Key] = keys[j]
+		}
+		desc := sortDir(e.Value) < 0
+		switch {
+		case keys[i] == nil && desc:
+			// nothing sorts below null
+			continue
+		case keys[i] == nil:
+			clause[e.Key] = bson.M{"$ne": nil}
+		case desc:
+			clause["$or"] = bson.A{
+				bson.M{e.Key: bson.M{"$lt": keys[i]}},
+				bson.M{e.Key: nil},
+			}
+		default:
+			clause[e.Key] = bson.M{"$gt": keys[i]}
+		}
+		or = append(or, clause)
+	}
+	return bson.M{"$or": or}
+}
+
+func sortKeys(raw bson.Raw, sort bson.D) bson.A {
+	keys := make(bson.A, len(sort))
+	for i, e := range sort {
+		rv, err := raw.LookupErr(strings.Split(e.Key, ".")...)
+		if err != nil {
+			continue
+		}
+		var v interface{}
+		if rv.Unmarshal(&v) == nil {
+			keys[i] = v
+		}
+	}
+	return keys
+}
@@ -0,0 +1,169 @@
+package morm
+
+import (
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DiffDoc is implemented by docs whose update records carry the changed
+// field paths with their before and after values. Values of the fields
+// returned by RedactFields, or of anything below them, are masked.
+type DiffDoc interface {
+	RedactFields() []string
+}
+
+const RedactedValue = "***"
+
+type FieldChange struct {
+	Field  string      `bson:"field"`
+	Before interface{} `bson:"before"`
+	After  interface{} `bson:"after"`
+}
+
+func isRedacted(field string, redact []string) bool {
+	for _, r := range redact {
+		if field == r || strings.HasPrefix(field, r+".") || strings.HasPrefix(r, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func newFieldChange(field string, before, after interface{}, redact []string) *FieldChange {
+	if isRedacted(field, redact) {
+		if before != nil {
+			before = RedactedValue
+		}
+		if after != nil {
+			after = RedactedValue
+		}
+	}
+	return &FieldChange{Field: field, Before: before, After: after}
+}
+
+// diffFields compares the $set fields of an update with the stored doc.
+func diffFields(stored bson.D, fields bson.D, redact []string) ([]*FieldChange, error) {
+	var changes []*FieldChange
+	for _, f := range fields {
+		if f.Key == "records" || f.Key == FieldVersion {
+			continue
+		}
+		before, _ := lookupPath(stored, f.Key)
+		after, err := normalizeValue(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		if valuesEqual(before, after) {
+			continue
+		}
+		changes = append(changes, newFieldChange(f.Key, before, after, redact))
+	}
+	return changes, nil
+}
+
+// diffUnset lists the fields an $unset removes from the stored doc.
+func diffUnset(stored bson.D, fields []string, redact []string) []*FieldChange {
+	var changes []*FieldChange
+	for _, f := range fields {
+		if before, ok := lookupPath(stored, f); ok {
+			changes = append(changes, newFieldChange(f, before, nil, redact))
+		}
+	}
+	return changes
+}
+
+func attachChanges(records []*Record, changes []*FieldChange) {
+	if len(records) > 0 {
+		records[len(records)-1].Changes = changes
+	}
+}
+
+// changesOf diffs fields against the stored version of d, it returns nil
+// when d is not a DiffDoc.
+func (mm *mgoModelImpl) changesOf(d DocInter, fields bson.D) ([]*FieldChange, error) {
+	dd, ok := d.(DiffDoc)
+	if !ok {
+		return nil, nil
+	}
+	var stored bson.D
+	err := mm.db.Collection(d.GetC()).FindOne(mm.ctx, bson.M{"_id": d.GetID()}).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return diffFields(stored, fields, dd.RedactFields())
+}
+
+func (mm *mgoModelImpl) findDocs(d DocInter, q bson.M) ([]bson.D, error) {
+	cursor, err := mm.db.Collection(d.GetC()).Find(mm.ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.D
+	err = cursor.All(mm.ctx, &docs)
+	return docs, err
+}
+
+// updateEach applies update to every doc matching q one at a time so each
+// doc gets an audit entry with its own changes, docs no longer matching q
+// when their turn comes are left out.
+func (mm *mgoModelImpl) updateEach(
+	d DocInter, q bson.M, update bson.D, u LogUser,
+	action, summary string,
+	diff func(stored bson.D) ([]*FieldChange, error),
+) (int64, error) {
+	history := isHistoryDoc(d)
+	if !history {
+		if err := mm.initRecords(d, q); err != nil {
+			return 0, err
+		}
+	}
+	stored, err := mm.findDocs(d, q)
+	if err != nil || len(stored) == 0 {
+		return 0, err
+	}
+	collection := mm.db.Collection(d.GetC())
+	now := time.Now()
+	var entries []*History
+	var modified int64
+	for _, sd := range stored {
+		id, _ := docGet(sd, "_id")
+		changes, err := diff(sd)
+		if err != nil {
+			return modified, err
+		}
+		op := update
+		if !history {
+			record := NewRecord(now, u.GetAccount(), u.GetName(), summary)
+			record.Changes = changes
+			op = append(append(bson.D{}, update...), primitive.E{Key: "$push", Value: primitive.M{"records": record}})
+		}
+		filter := bson.M{"_id": id}
+		if len(q) > 0 {
+			filter = bson.M{"$and": bson.A{q, filter}}
+		}
+		result, err := collection.UpdateOne(mm.ctx, filter, op)
+		if err != nil {
+			if histErr := mm.writeHistory(d, entries); histErr != nil {
+				return modified, histErr
+			}
+			return modified, err
+		}
+		modified += result.ModifiedCount
+		if history && result.MatchedCount > 0 {
+			entry := newHistoryEntries([]interface{}{id}, u, action, summary)[0]
+			entry.Changes = changes
+			entries = append(entries, entry)
+		}
+	}
+	if history {
+		err = mm.writeHistory(d, entries)
+	}
+	return modified, err
+}
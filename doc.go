@@ -27,6 +27,47 @@ type DocInter interface {
 	GetIndexes() []mongo.IndexModel
 }
 
+// SoftDeleteDoc is implemented by docs that RemoveByID and RemoveAll only
+// mark as deleted, embed SoftDelete with `bson:",inline"` to opt in.
+type SoftDeleteDoc interface {
+	IsDeleted() bool
+}
+
+const (
+	FieldDeletedAt = "deletedAt"
+	FieldDeletedBy = "deletedBy"
+)
+
+type SoftDelete struct {
+	DeletedAt *time.Time `bson:"deletedAt,omitempty"`
+	DeletedBy string     `bson:"deletedBy,omitempty"`
+}
+
+func (s *SoftDelete) IsDeleted() bool {
+	return s != nil && s.DeletedAt != nil
+}
+
+// VersionDoc is implemented by docs guarded by optimistic locking, embed
+// CommonVersion to opt in.
+type VersionDoc interface {
+	GetVersion() int64
+	SetVersion(v int64)
+}
+
+const FieldVersion = "version"
+
+type CommonVersion struct {
+	Version int64 `bson:"version"`
+}
+
+func (c *CommonVersion) GetVersion() int64 {
+	return c.Version
+}
+
+func (c *CommonVersion) SetVersion(v int64) {
+	c.Version = v
+}
+
 type ListDoc interface {
 	GetID() string
 	GetC() string
@@ -52,6 +93,7 @@ type Record struct {
 	Summary  string
 	Account  string
 	Name     string
+	Changes  []*FieldChange `bson:"changes,omitempty"`
 }
 
 func (c *CommonDoc) AddRecord(u LogUser, msg string) []*Record {
@@ -1,21 +1,43 @@
 package morm
 
 import (
+	"bufio"
+	"context"
 	"encoding/csv"
+	"encoding/json"
 	"io"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/wayne011872/morm/format"
 )
 
 type MgoDS interface {
 	Exec(exec func(i interface{}) error) error
+	// ExecParallel runs exec on up to workers goroutines, the first error
+	// cancels the cursor and is returned
+	ExecParallel(workers int, exec func(i interface{}) error) error
+	// ExecParallelOrdered runs process concurrently and hands its results
+	// to emit one at a time in cursor order
+	ExecParallelOrdered(workers int, process func(i interface{}) (interface{}, error), emit func(result interface{}) error) error
 	ExportCSV(w io.Writer, title []string, exec func(writer *csv.Writer, i interface{}) error) error
+	ExportTSV(w io.Writer, title []string, exec func(writer *csv.Writer, i interface{}) error) error
+	// ExportNDJSON writes one JSON line per doc, converted by f when not nil
+	ExportNDJSON(w io.Writer, f format.ObjToMapFunc) error
+	ExportJSONArray(w io.Writer, f format.ObjToMapFunc) error
+	// ExportXLSX writes a single sheet, rows past its limit of 1,048,576
+	// fail with ErrSheetFull
+	ExportXLSX(w io.Writer, title []string, exec func(writer SheetWriter, i interface{}) error) error
+	// ExportTaggedCSV writes the columns declared by csv struct tags, only
+	// the given ones and in their order when columns is not empty
+	ExportTaggedCSV(w io.Writer, columns ...string) error
 }
 
 func (mm *mgoModelImpl) NewFindMgoDS(d DocInter, q bson.M, opts ...*options.FindOptions) MgoDS {
 	return &findDsImpl{
 		MgoDBModel: mm,
+		ctx:        mm.ctx,
 		d:          d,
 		q:          q,
 		opts:       opts,
@@ -24,6 +46,7 @@ func (mm *mgoModelImpl) NewFindMgoDS(d DocInter, q bson.M, opts ...*options.Find
 
 type findDsImpl struct {
 	MgoDBModel
+	ctx  context.Context
 	d    DocInter
 	q    bson.M
 	opts []*options.FindOptions
@@ -34,20 +57,33 @@ func (mm *findDsImpl) Exec(exec func(i interface{}) error) error {
 }
 
 func (mm *findDsImpl) ExportCSV(w io.Writer, title []string, exec func(writer *csv.Writer, i interface{}) error) error {
-	csvWriter := csv.NewWriter(w)
-	err := csvWriter.Write(title)
-	defer csvWriter.Flush()
-	if err != nil {
-		return err
-	}
-	return mm.FindAndExec(mm.d, mm.q, func(i interface{}) error {
-		return exec(csvWriter, i)
-	}, mm.opts...)
+	return exportDelimited(mm.Exec, w, ',', title, exec)
+}
+
+func (mm *findDsImpl) ExportTSV(w io.Writer, title []string, exec func(writer *csv.Writer, i interface{}) error) error {
+	return exportDelimited(mm.Exec, w, '\t', title, exec)
+}
+
+func (mm *findDsImpl) ExportNDJSON(w io.Writer, f format.ObjToMapFunc) error {
+	return exportNDJSON(mm.Exec, w, f)
+}
+
+func (mm *findDsImpl) ExportJSONArray(w io.Writer, f format.ObjToMapFunc) error {
+	return exportJSONArray(mm.Exec, w, f)
+}
+
+func (mm *findDsImpl) ExportXLSX(w io.Writer, title []string, exec func(writer SheetWriter, i interface{}) error) error {
+	return exportXLSX(mm.Exec, w, title, exec)
+}
+
+func (mm *findDsImpl) ExportTaggedCSV(w io.Writer, columns ...string) error {
+	return exportTaggedCSV(mm.Exec, mm.d, w, columns)
 }
 
 func (mm *mgoModelImpl) NewPipeFindMgoDS(d MgoAggregate, q bson.M, opts ...*options.AggregateOptions) MgoDS {
 	return &pipeFindDsImpl{
 		MgoDBModel: mm,
+		ctx:        mm.ctx,
 		d:          d,
 		q:          q,
 		opts:       opts,
@@ -56,6 +92,7 @@ func (mm *mgoModelImpl) NewPipeFindMgoDS(d MgoAggregate, q bson.M, opts ...*opti
 
 type pipeFindDsImpl struct {
 	MgoDBModel
+	ctx  context.Context
 	d    MgoAggregate
 	q    bson.M
 	opts []*options.AggregateOptions
@@ -66,14 +103,126 @@ func (mm *pipeFindDsImpl) Exec(exec func(i interface{}) error) error {
 }
 
 func (mm *pipeFindDsImpl) ExportCSV(w io.Writer, title []string, exec func(writer *csv.Writer, i interface{}) error) error {
+	return exportDelimited(mm.Exec, w, ',', title, exec)
+}
+
+func (mm *pipeFindDsImpl) ExportTSV(w io.Writer, title []string, exec func(writer *csv.Writer, i interface{}) error) error {
+	return exportDelimited(mm.Exec, w, '\t', title, exec)
+}
+
+func (mm *pipeFindDsImpl) ExportNDJSON(w io.Writer, f format.ObjToMapFunc) error {
+	return exportNDJSON(mm.Exec, w, f)
+}
+
+func (mm *pipeFindDsImpl) ExportJSONArray(w io.Writer, f format.ObjToMapFunc) error {
+	return exportJSONArray(mm.Exec, w, f)
+}
+
+func (mm *pipeFindDsImpl) ExportXLSX(w io.Writer, title []string, exec func(writer SheetWriter, i interface{}) error) error {
+	return exportXLSX(mm.Exec, w, title, exec)
+}
+
+func (mm *pipeFindDsImpl) ExportTaggedCSV(w io.Writer, columns ...string) error {
+	return exportTaggedCSV(mm.Exec, mm.d, w, columns)
+}
+
+type execFunc func(exec func(i interface{}) error) error
+
+func exportDelimited(run execFunc, w io.Writer, comma rune, title []string, exec func(writer *csv.Writer, i interface{}) error) error {
 	csvWriter := csv.NewWriter(w)
+	csvWriter.Comma = comma
 	err := csvWriter.Write(title)
-	defer csvWriter.Flush()
 	if err != nil {
 		return err
 	}
-	return mm.PipeFindAndExec(mm.d, mm.q, func(i interface{}) error {
-		err = exec(csvWriter, i)
+	err = run(func(i interface{}) error {
+		return exec(csvWriter, i)
+	})
+	csvWriter.Flush()
+	if err != nil {
+		return err
+	}
+	return csvWriter.Error()
+}
+
+func exportNDJSON(run execFunc, w io.Writer, f format.ObjToMapFunc) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err := run(func(i interface{}) error {
+		v, ok := exportValue(i, f)
+		if !ok {
+			return nil
+		}
+		return enc.Encode(v)
+	})
+	if err != nil {
 		return err
-	}, mm.opts...)
+	}
+	return bw.Flush()
+}
+
+func exportJSONArray(run execFunc, w io.Writer, f format.ObjToMapFunc) error {
+	bw := bufio.NewWriter(w)
+	sep := "["
+	err := run(func(i interface{}) error {
+		v, ok := exportValue(i, f)
+		if !ok {
+			return nil
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err = bw.WriteString(sep); err != nil {
+			return err
+		}
+		sep = ","
+		_, err = bw.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sep == "[" {
+		if _, err = bw.WriteString(sep); err != nil {
+			return err
+		}
+	}
+	if _, err = bw.WriteString("]\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// exportValue applies f like format.DocToMap does, skipping docs it maps
+// to nil.
+func exportValue(i interface{}, f format.ObjToMapFunc) (interface{}, bool) {
+	if f == nil {
+		return i, true
+	}
+	m := f(i)
+	return m, m != nil
+}
+
+func exportXLSX(run execFunc, w io.Writer, title []string, exec func(writer SheetWriter, i interface{}) error) error {
+	xw, err := newXLSXWriter(w)
+	if err != nil {
+		return err
+	}
+	if len(title) > 0 {
+		cells := make([]interface{}, len(title))
+		for i, t := range title {
+			cells[i] = t
+		}
+		if err = xw.Write(cells); err != nil {
+			return err
+		}
+	}
+	err = run(func(i interface{}) error {
+		return exec(xw, i)
+	})
+	if err != nil {
+		return err
+	}
+	return xw.Close()
 }
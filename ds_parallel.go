@@ -0,0 +1,166 @@
+package morm
+
+import (
+	"context"
+	"sync"
+)
+
+// runParallel feeds the docs of run to workers goroutines calling process.
+// With emit the results are handed to it one at a time in cursor order,
+// at most 2*workers of them being held at once. The first error cancels
+// the context given to run and is returned, as is the error of parent
+// when it is done before every doc was processed.
+func runParallel(
+	parent context.Context, workers int,
+	run func(ctx context.Context, exec func(i interface{}) error) error,
+	process func(i interface{}) (interface{}, error),
+	emit func(result interface{}) error,
+) error {
+	if workers < 1 {
+		workers = 1
+	}
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	type job struct {
+		seq int
+		doc interface{}
+	}
+	type result struct {
+		seq   int
+		value interface{}
+	}
+	jobs := make(chan job)
+	results := make(chan result, workers)
+	slots := make(chan struct{}, 2*workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := ctx.Err(); err != nil {
+					fail(err)
+					continue
+				}
+				v, err := process(j.doc)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				if emit == nil {
+					continue
+				}
+				select {
+				case results <- result{seq: j.seq, value: v}:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+	emitted := make(chan struct{})
+	go func() {
+		defer close(emitted)
+		pending := map[int]interface{}{}
+		next := 0
+		for r := range results {
+			pending[r.seq] = r.value
+			for {
+				v, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+				if err := ctx.Err(); err != nil {
+					fail(err)
+				} else if err := emit(v); err != nil {
+					fail(err)
+				}
+				<-slots
+			}
+		}
+	}()
+
+	seq := 0
+	runErr := run(ctx, func(i interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if emit != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case jobs <- job{seq: seq, doc: i}:
+			seq++
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(jobs)
+	wg.Wait()
+	close(results)
+	<-emitted
+	if firstErr != nil {
+		return firstErr
+	}
+	if runErr == nil {
+		// the cursor may end without error when parent is done
+		runErr = parent.Err()
+	}
+	return runErr
+}
+
+func (mm *findDsImpl) ExecParallel(workers int, exec func(i interface{}) error) error {
+	return runParallel(mm.ctx, workers, mm.runWith, func(i interface{}) (interface{}, error) {
+		return nil, exec(i)
+	}, nil)
+}
+
+func (mm *findDsImpl) ExecParallelOrdered(workers int, process func(i interface{}) (interface{}, error), emit func(result interface{}) error) error {
+	return runParallel(mm.ctx, workers, mm.runWith, process, emit)
+}
+
+// runWith does not copy the last doc into mm.d, the runs of the parallel
+// exports would race on it.
+func (mm *findDsImpl) runWith(ctx context.Context, exec func(i interface{}) error) error {
+	m := mm.WithContext(ctx)
+	if impl, ok := m.(*mgoModelImpl); ok {
+		return impl.findAndExec(mm.d, mm.q, exec, false, mm.opts...)
+	}
+	return m.FindAndExec(mm.d, mm.q, exec, mm.opts...)
+}
+
+func (mm *pipeFindDsImpl) ExecParallel(workers int, exec func(i interface{}) error) error {
+	return runParallel(mm.ctx, workers, mm.runWith, func(i interface{}) (interface{}, error) {
+		return nil, exec(i)
+	}, nil)
+}
+
+func (mm *pipeFindDsImpl) ExecParallelOrdered(workers int, process func(i interface{}) (interface{}, error), emit func(result interface{}) error) error {
+	return runParallel(mm.ctx, workers, mm.runWith, process, emit)
+}
+
+func (mm *pipeFindDsImpl) runWith(ctx context.Context, exec func(i interface{}) error) error {
+	m := mm.WithContext(ctx)
+	if impl, ok := m.(*mgoModelImpl); ok {
+		return impl.pipeFindAndExec(mm.d, mm.q, exec, false, mm.opts...)
+	}
+	return m.PipeFindAndExec(mm.d, mm.q, exec, mm.opts...)
+}
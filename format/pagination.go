@@ -2,6 +2,7 @@ package format
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"math"
 )
@@ -11,6 +12,13 @@ type PaginationSource interface {
 	Data(limit, p int64, format ObjToMapFunc) ([]map[string]interface{}, error)
 }
 
+// CountDataSource can return the total and a page of rows in one call.
+// NewPagination prefers CountData over Count followed by Data.
+type CountDataSource interface {
+	PaginationSource
+	CountData(limit, p int64, format ObjToMapFunc) (total int64, rows []map[string]interface{}, err error)
+}
+
 type Pagination interface {
 	Output(w io.Writer) error
 	GetRows() interface{}
@@ -18,9 +26,16 @@ type Pagination interface {
 	GetPage() int64
 }
 
+// TotalPagination is implemented by the pages of NewPagination, which know
+// the total of rows.
+type TotalPagination interface {
+	Pagination
+	GetTotal() int64
+}
+
 type paginationImpl struct {
-	Rows     interface{} `json:"rows,omitempty"`
-	Total    int64       `json:"total,omitempty"`
+	Rows     interface{} `json:"rows"`
+	Total    int64       `json:"total"`
 	AllPages int64       `json:"allPages,omitempty"`
 	Page     int64       `json:"page,omitempty"`
 	Limit    int64       `json:"limit,omitempty"`
@@ -43,39 +58,231 @@ func (pi *paginationImpl) GetAllPages() int64 {
 func (pi *paginationImpl) GetPage() int64 {
 	return pi.Page
 }
+func (pi *paginationImpl) GetTotal() int64 {
+	return pi.Total
+}
+
+var ErrPageOutOfRange = errors.New("page out of range")
+
+// PageOverflow says what to do with a page past the last one.
+type PageOverflow int
+
+const (
+	// OverflowClamp returns the last page instead.
+	OverflowClamp PageOverflow = iota
+	// OverflowEmpty returns the requested page with no rows.
+	OverflowEmpty
+	// OverflowError fails with ErrPageOutOfRange.
+	OverflowError
+)
+
+// PaginationConfig controls limits and out of range pages. Zero fields
+// fall back to DefaultPaginationConfig.
+type PaginationConfig struct {
+	// DefaultLimit is used when the requested limit is below 1 or above
+	// MaxLimit.
+	DefaultLimit int64
+	MaxLimit     int64
+	// ClampLimit uses MaxLimit instead of DefaultLimit for a limit above it.
+	ClampLimit bool
+	Overflow   PageOverflow
+}
 
+var DefaultPaginationConfig = PaginationConfig{
+	DefaultLimit: 100,
+	MaxLimit:     MaxLimit,
+	Overflow:     OverflowClamp,
+}
+
+func (c PaginationConfig) limit(limit int64) int64 {
+	maxLimit := c.MaxLimit
+	if maxLimit < 1 {
+		maxLimit = DefaultPaginationConfig.MaxLimit
+	}
+	if limit > maxLimit && c.ClampLimit {
+		return maxLimit
+	}
+	if limit < 1 || limit > maxLimit {
+		limit = c.DefaultLimit
+		if limit < 1 {
+			limit = DefaultPaginationConfig.DefaultLimit
+		}
+	}
+	return limit
+}
+
+// NewPagination pages source with DefaultPaginationConfig.
 func NewPagination(
 	source PaginationSource,
 	limit, page int64,
 	format func(i interface{}) map[string]interface{},
 ) (Pagination, error) {
-	total, err := source.Count()
+	return DefaultPaginationConfig.NewPagination(source, limit, page, format)
+}
 
+// NewPagination returns the page of source. With no results it returns an
+// empty Pagination with a total of 0, never nil.
+func (c PaginationConfig) NewPagination(
+	source PaginationSource,
+	limit, page int64,
+	format func(i interface{}) map[string]interface{},
+) (Pagination, error) {
+	limit = c.limit(limit)
+	if page < 1 {
+		page = 1
+	}
+	if cd, ok := source.(CountDataSource); ok {
+		return c.newCountDataPagination(cd, limit, page, format)
+	}
+	total, err := source.Count()
 	if err != nil {
 		return nil, err
 	}
 	if total == 0 {
-		return nil, nil
-	}
-	if limit < 1 || limit > MaxLimit {
-		limit = 100
+		return newEmptyPagination(0, 0, page, limit), nil
 	}
 	totalPage := int64(math.Ceil(float64(total) / float64(limit)))
-
 	if page > totalPage {
+		switch c.Overflow {
+		case OverflowEmpty:
+			return newEmptyPagination(total, totalPage, page, limit), nil
+		case OverflowError:
+			return nil, ErrPageOutOfRange
+		}
 		page = totalPage
-	} else if page < 1 {
-		page = 1
 	}
 	result, err := source.Data(limit, page, format)
 	if err != nil {
 		return nil, err
 	}
 	return &paginationImpl{
-		Rows:     result,
+		Rows:     rowsOrEmpty(result),
 		Total:    total,
 		AllPages: totalPage,
 		Page:     page,
 		Limit:    limit,
 	}, nil
 }
+
+// newCountDataPagination fetches the requested page together with the
+// total and only asks again when the page turns out to be past the end.
+func (c PaginationConfig) newCountDataPagination(
+	source CountDataSource,
+	limit, page int64,
+	format func(i interface{}) map[string]interface{},
+) (Pagination, error) {
+	total, result, err := source.CountData(limit, page, format)
+	if err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return newEmptyPagination(0, 0, page, limit), nil
+	}
+	totalPage := int64(math.Ceil(float64(total) / float64(limit)))
+	if page > totalPage {
+		switch c.Overflow {
+		case OverflowEmpty:
+			return newEmptyPagination(total, totalPage, page, limit), nil
+		case OverflowError:
+			return nil, ErrPageOutOfRange
+		}
+		page = totalPage
+		if total, result, err = source.CountData(limit, page, format); err != nil {
+			return nil, err
+		}
+	}
+	return &paginationImpl{
+		Rows:     rowsOrEmpty(result),
+		Total:    total,
+		AllPages: totalPage,
+		Page:     page,
+		Limit:    limit,
+	}, nil
+}
+
+func newEmptyPagination(total, allPages, page, limit int64) Pagination {
+	return &paginationImpl{
+		Rows:     []map[string]interface{}{},
+		Total:    total,
+		AllPages: allPages,
+		Page:     page,
+		Limit:    limit,
+	}
+}
+
+func rowsOrEmpty(rows []map[string]interface{}) []map[string]interface{} {
+	if rows == nil {
+		return []map[string]interface{}{}
+	}
+	return rows
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// CursorPaginationSource pages by position. cursor is empty for the first
+// page or a token returned by a previous call; next and prev are empty when
+// there is nothing more in that direction.
+type CursorPaginationSource interface {
+	CursorData(limit int64, cursor string, format ObjToMapFunc) (rows []map[string]interface{}, next, prev string, err error)
+}
+
+type CursorPagination interface {
+	Pagination
+	GetNext() string
+	GetPrev() string
+}
+
+type cursorPaginationImpl struct {
+	Rows  interface{} `json:"rows"`
+	Limit int64       `json:"limit,omitempty"`
+	Next  string      `json:"next,omitempty"`
+	Prev  string      `json:"prev,omitempty"`
+}
+
+func (pi *cursorPaginationImpl) Output(w io.Writer) error {
+	return json.NewEncoder(w).Encode(pi)
+}
+
+func (pi *cursorPaginationImpl) GetRows() interface{} {
+	return pi.Rows
+}
+func (pi *cursorPaginationImpl) GetAllPages() int64 {
+	return 0
+}
+func (pi *cursorPaginationImpl) GetPage() int64 {
+	return 0
+}
+func (pi *cursorPaginationImpl) GetNext() string {
+	return pi.Next
+}
+func (pi *cursorPaginationImpl) GetPrev() string {
+	return pi.Prev
+}
+
+// NewCursorPagination fetches the page at cursor without counting the
+// total.
+func NewCursorPagination(
+	source CursorPaginationSource,
+	limit int64, cursor string,
+	format func(i interface{}) map[string]interface{},
+) (CursorPagination, error) {
+	return DefaultPaginationConfig.NewCursorPagination(source, limit, cursor, format)
+}
+
+func (c PaginationConfig) NewCursorPagination(
+	source CursorPaginationSource,
+	limit int64, cursor string,
+	format func(i interface{}) map[string]interface{},
+) (CursorPagination, error) {
+	limit = c.limit(limit)
+	rows, next, prev, err := source.CursorData(limit, cursor, format)
+	if err != nil {
+		return nil, err
+	}
+	return &cursorPaginationImpl{
+		Rows:  rowsOrEmpty(rows),
+		Limit: limit,
+		Next:  next,
+		Prev:  prev,
+	}, nil
+}
@@ -0,0 +1,299 @@
+package format
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Renderer writes a Pagination in one output format. A nil p renders as
+// no rows.
+type Renderer interface {
+	ContentType() string
+	Render(w io.Writer, p Pagination) error
+}
+
+var (
+	// JSON writes the pagination envelope, same as Pagination.Output.
+	JSON Renderer = jsonRenderer{}
+	// JSONRows writes only the rows as a JSON array.
+	JSONRows Renderer = jsonRowsRenderer{}
+	// NDJSON writes one JSON row per line.
+	NDJSON Renderer = ndjsonRenderer{}
+)
+
+type jsonRenderer struct{}
+
+func (jsonRenderer) ContentType() string {
+	return "application/json"
+}
+
+func (jsonRenderer) Render(w io.Writer, p Pagination) error {
+	if p == nil {
+		_, err := io.WriteString(w, "{}\n")
+		return err
+	}
+	return p.Output(w)
+}
+
+type jsonRowsRenderer struct{}
+
+func (jsonRowsRenderer) ContentType() string {
+	return "application/json"
+}
+
+func (jsonRowsRenderer) Render(w io.Writer, p Pagination) error {
+	rows, err := rowsOf(p)
+	if err != nil {
+		return err
+	}
+	if rows == nil {
+		rows = []map[string]interface{}{}
+	}
+	return json.NewEncoder(w).Encode(rows)
+}
+
+type ndjsonRenderer struct{}
+
+func (ndjsonRenderer) ContentType() string {
+	return "application/x-ndjson"
+}
+
+func (ndjsonRenderer) Render(w io.Writer, p Pagination) error {
+	rows, err := rowsOf(p)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, r := range rows {
+		if err = enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CSV writes the rows with a header line. Without columns every key found
+// in the rows is written, sorted by name.
+func CSV(columns ...string) Renderer {
+	return csvRenderer{columns: columns}
+}
+
+type csvRenderer struct {
+	columns []string
+}
+
+func (csvRenderer) ContentType() string {
+	return "text/csv; charset=utf-8"
+}
+
+func (cr csvRenderer) Render(w io.Writer, p Pagination) error {
+	rows, err := rowsOf(p)
+	if err != nil {
+		return err
+	}
+	columns := cr.columns
+	if len(columns) == 0 {
+		columns = rowKeys(rows)
+	}
+	cw := csv.NewWriter(w)
+	if err = cw.Write(columns); err != nil {
+		return err
+	}
+	record := make([]string, len(columns))
+	for _, r := range rows {
+		for i, c := range columns {
+			if record[i], err = csvValue(r[c]); err != nil {
+				return err
+			}
+		}
+		if err = cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func rowKeys(rows []map[string]interface{}) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, r := range rows {
+		for k := range r {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func csvValue(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case time.Time:
+		return t.Format(time.RFC3339), nil
+	case *time.Time:
+		if t == nil {
+			return "", nil
+		}
+		return t.Format(time.RFC3339), nil
+	case bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return fmt.Sprint(t), nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var str string
+	if json.Unmarshal(b, &str) == nil {
+		return str, nil
+	}
+	return string(b), nil
+}
+
+// rowsOf returns the rows of p as maps, converting other row types
+// through JSON.
+func rowsOf(p Pagination) ([]map[string]interface{}, error) {
+	if p == nil {
+		return nil, nil
+	}
+	switch rows := p.GetRows().(type) {
+	case nil:
+		return nil, nil
+	case []map[string]interface{}:
+		return rows, nil
+	default:
+		b, err := json.Marshal(rows)
+		if err != nil {
+			return nil, err
+		}
+		var result []map[string]interface{}
+		err = json.Unmarshal(b, &result)
+		return result, err
+	}
+}
+
+// RendererFor picks a renderer from an Accept header value by preference,
+// falling back to JSON.
+func RendererFor(accept string) Renderer {
+	var best Renderer = JSON
+	bestQ := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		var r Renderer
+		switch mt {
+		case "application/json":
+			r = JSON
+		case "text/csv":
+			r = CSV()
+		case "application/x-ndjson", "application/jsonl", "application/json-seq":
+			r = NDJSON
+		}
+		if r != nil && q > 0 && q > bestQ {
+			best, bestQ = r, q
+		}
+	}
+	return best
+}
+
+// HTTPWriter writes a Pagination as an HTTP response: paging goes into
+// RFC 8288 Link headers and X-Total-Count, the rows into the body.
+type HTTPWriter struct {
+	// PageParam is the query parameter holding the page, "page" if empty.
+	PageParam string
+	// CursorParam is the query parameter holding the cursor of a
+	// CursorPagination, "cursor" if empty.
+	CursorParam string
+	// Renderer writes the body. When nil it is picked from the Accept
+	// header, with JSON meaning JSONRows.
+	Renderer Renderer
+}
+
+func WriteHTTP(w http.ResponseWriter, req *http.Request, p Pagination) error {
+	return HTTPWriter{}.Write(w, req, p)
+}
+
+func (hw HTTPWriter) Write(w http.ResponseWriter, req *http.Request, p Pagination) error {
+	r := hw.Renderer
+	if r == nil {
+		r = RendererFor(req.Header.Get("Accept"))
+		if _, ok := r.(jsonRenderer); ok {
+			r = JSONRows
+		}
+	}
+	h := w.Header()
+	h.Set("Content-Type", r.ContentType())
+	if links := hw.links(req, p); len(links) > 0 {
+		h.Set("Link", strings.Join(links, ", "))
+	}
+	if tp, ok := p.(TotalPagination); ok {
+		h.Set("X-Total-Count", strconv.FormatInt(tp.GetTotal(), 10))
+	} else if p == nil {
+		h.Set("X-Total-Count", "0")
+	}
+	w.WriteHeader(http.StatusOK)
+	return r.Render(w, p)
+}
+
+func (hw HTTPWriter) links(req *http.Request, p Pagination) []string {
+	if p == nil {
+		return nil
+	}
+	var links []string
+	link := func(param, value, rel string) {
+		q := req.URL.Query()
+		q.Set(param, value)
+		u := url.URL{Path: req.URL.Path, RawQuery: q.Encode()}
+		links = append(links, fmt.Sprintf("<%s>; rel=\"%s\"", u.String(), rel))
+	}
+	if cp, ok := p.(CursorPagination); ok {
+		param := hw.CursorParam
+		if param == "" {
+			param = "cursor"
+		}
+		if cp.GetPrev() != "" {
+			link(param, cp.GetPrev(), "prev")
+		}
+		if cp.GetNext() != "" {
+			link(param, cp.GetNext(), "next")
+		}
+		return links
+	}
+	param := hw.PageParam
+	if param == "" {
+		param = "page"
+	}
+	page, last := p.GetPage(), p.GetAllPages()
+	link(param, "1", "first")
+	if page > 1 {
+		link(param, strconv.FormatInt(page-1, 10), "prev")
+	}
+	if page < last {
+		link(param, strconv.FormatInt(page+1, 10), "next")
+	}
+	link(param, strconv.FormatInt(last, 10), "last")
+	return links
+}
@@ -0,0 +1,159 @@
+package morm
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/wayne011872/morm/format"
+)
+
+// HistoryDoc is implemented by docs whose audit records are written to a
+// separate history collection instead of their own records field.
+// GetHistoryC usually returns HistoryC(d.GetC()).
+type HistoryDoc interface {
+	GetHistoryC() string
+}
+
+func HistoryC(c string) string {
+	return c + "_history"
+}
+
+const (
+	HistoryCreate  = "create"
+	HistoryUpdate  = "update"
+	HistoryDelete  = "delete"
+	HistoryRestore = "restore"
+)
+
+type History struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	DocID    interface{}        `bson:"docId"`
+	Action   string             `bson:"action"`
+	Account  string             `bson:"account"`
+	Name     string             `bson:"name"`
+	Datetime time.Time          `bson:"datetime"`
+	Summary  string             `bson:"summary"`
+	Changes  []*FieldChange     `bson:"changes,omitempty"`
+
+	c string
+}
+
+func newHistory(d DocInter) *History {
+	c := HistoryC(d.GetC())
+	if hd, ok := d.(HistoryDoc); ok {
+		c = hd.GetHistoryC()
+	}
+	return &History{c: c}
+}
+
+func (h *History) GetC() string {
+	return h.c
+}
+
+func (h *History) GetID() interface{} {
+	return h.ID
+}
+
+func (h *History) GetDoc() interface{} {
+	return h
+}
+
+func (h *History) SetCreator(u LogUser) {}
+
+func (h *History) AddRecord(u LogUser, msg string) []*Record {
+	return nil
+}
+
+func (h *History) GetIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{Keys: bson.D{{Key: "docId", Value: 1}, {Key: "datetime", Value: -1}}},
+	}
+}
+
+func isHistoryDoc(d interface{}) bool {
+	_, ok := d.(HistoryDoc)
+	return ok
+}
+
+func newHistoryEntries(ids []interface{}, u LogUser, action, summary string) []*History {
+	now := time.Now()
+	entries := make([]*History, len(ids))
+	for i, id := range ids {
+		entries[i] = &History{
+			ID:       primitive.NewObjectID(),
+			DocID:    id,
+			Action:   action,
+			Account:  u.GetAccount(),
+			Name:     u.GetName(),
+			Datetime: now,
+			Summary:  summary,
+		}
+	}
+	return entries
+}
+
+func (mm *mgoModelImpl) writeHistory(d DocInter, entries []*History) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	proto := newHistory(d)
+	if !mm.disableCheckBeforeSave {
+		if err := mm.CreateCollection(proto); err != nil {
+			return err
+		}
+	}
+	docs := make([]interface{}, len(entries))
+	for i, h := range entries {
+		docs[i] = h
+	}
+	_, err := mm.db.Collection(proto.GetC()).InsertMany(mm.ctx, docs)
+	return err
+}
+
+// findIDs returns the _id of every doc matching q.
+func (mm *mgoModelImpl) findIDs(d DocInter, q bson.M) ([]interface{}, error) {
+	cursor, err := mm.db.Collection(d.GetC()).Find(mm.ctx, q, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err = cursor.All(mm.ctx, &rows); err != nil {
+		return nil, err
+	}
+	ids := make([]interface{}, len(rows))
+	for i, r := range rows {
+		ids[i] = r.ID
+	}
+	return ids, nil
+}
+
+// GetHistoryPaginationSource pages the history of d, newest first.
+func (mm *mgoModelImpl) GetHistoryPaginationSource(d DocInter) format.PaginationSource {
+	return mm.GetPaginationSource(newHistory(d), bson.M{"docId": d.GetID()},
+		options.Find().SetSort(bson.D{{Key: "datetime", Value: -1}, {Key: "_id", Value: -1}}))
+}
+
+// withoutDocs returns the docs whose _id is not in drop, with their ids.
+func withoutDocs(docs []bson.D, drop []interface{}) ([]bson.D, []interface{}) {
+	seen := make(map[string]bool, len(drop))
+	for _, id := range drop {
+		seen[fmt.Sprint(id)] = true
+	}
+	var kept []bson.D
+	var ids []interface{}
+	for _, doc := range docs {
+		id, _ := docGet(doc, "_id")
+		if !seen[fmt.Sprint(id)] {
+			kept = append(kept, doc)
+			ids = append(ids, id)
+		}
+	}
+	return kept, ids
+}
@@ -0,0 +1,100 @@
+package morm
+
+import "reflect"
+
+// Optional hooks a DocInter may implement, a hook error aborts the
+// operation. After hooks run once the write succeeded.
+type BeforeSaveHook interface {
+	BeforeSave() error
+}
+
+type AfterSaveHook interface {
+	AfterSave() error
+}
+
+type BeforeUpdateHook interface {
+	BeforeUpdate() error
+}
+
+type AfterUpdateHook interface {
+	AfterUpdate() error
+}
+
+type BeforeDeleteHook interface {
+	BeforeDelete() error
+}
+
+type AfterDeleteHook interface {
+	AfterDelete() error
+}
+
+type AfterFindHook interface {
+	AfterFind() error
+}
+
+func callBeforeSave(d interface{}) error {
+	if h, ok := d.(BeforeSaveHook); ok {
+		return h.BeforeSave()
+	}
+	return nil
+}
+
+func callAfterSave(d interface{}) error {
+	if h, ok := d.(AfterSaveHook); ok {
+		return h.AfterSave()
+	}
+	return nil
+}
+
+func callBeforeUpdate(d interface{}) error {
+	if h, ok := d.(BeforeUpdateHook); ok {
+		return h.BeforeUpdate()
+	}
+	return nil
+}
+
+func callAfterUpdate(d interface{}) error {
+	if h, ok := d.(AfterUpdateHook); ok {
+		return h.AfterUpdate()
+	}
+	return nil
+}
+
+func callBeforeDelete(d interface{}) error {
+	if h, ok := d.(BeforeDeleteHook); ok {
+		return h.BeforeDelete()
+	}
+	return nil
+}
+
+func callAfterDelete(d interface{}) error {
+	if h, ok := d.(AfterDeleteHook); ok {
+		return h.AfterDelete()
+	}
+	return nil
+}
+
+func callAfterFind(d interface{}) error {
+	if h, ok := d.(AfterFindHook); ok {
+		return h.AfterFind()
+	}
+	return nil
+}
+
+// callAfterFindAll runs AfterFind on every element of a slice result.
+func callAfterFindAll(slice interface{}) error {
+	v := reflect.ValueOf(slice)
+	if v.Kind() != reflect.Slice {
+		return nil
+	}
+	hookType := reflect.TypeOf((*AfterFindHook)(nil)).Elem()
+	if elem := v.Type().Elem(); elem.Kind() != reflect.Interface && !elem.Implements(hookType) {
+		return nil
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := callAfterFind(v.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,752 @@
+package morm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var objectIDType = reflect.TypeOf(primitive.ObjectID{})
+
+type ImportMode int
+
+const (
+	// ImportInsert saves rows with BatchSave, existing _ids fail. Rows
+	// without an ObjectID _id get a new one.
+	ImportInsert ImportMode = iota
+	// ImportUpsert writes rows with BatchUpdate, matching existing docs by
+	// _id or Key. Only the fields a row sets are written: the columns with
+	// a value, the keys of a line, or the fields Map changed.
+	ImportUpsert
+)
+
+type ImportOptions struct {
+	Mode ImportMode
+	// BatchSize is the number of rows per write, 500 when not set.
+	BatchSize int
+	// DryRun maps and validates every row without writing.
+	DryRun bool
+	// Key lists the bson fields matching existing docs in ImportUpsert,
+	// the _id when empty. Rows lacking them fail rather than upserting onto
+	// a zero value.
+	Key []string
+	// Map fills d from a row: the cells of a CSV record keyed by header or
+	// a decoded NDJSON object. When nil CSV columns are set through the csv
+	// struct tags and NDJSON lines are decoded with encoding/json.
+	Map func(row map[string]interface{}, d DocInter) error
+}
+
+// ImportRowError is the failure of the row at Line of the input.
+type ImportRowError struct {
+	Line int
+	Err  error
+}
+
+func (e *ImportRowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ImportRowError) Unwrap() error {
+	return e.Err
+}
+
+type ImportReport struct {
+	// Rows is the number of rows read.
+	Rows int
+	// Written counts the rows written, or that would be in a dry run.
+	Written int
+	Errors  []*ImportRowError
+}
+
+type Importer interface {
+	ImportCSV(r io.Reader, u LogUser) (*ImportReport, error)
+	ImportNDJSON(r io.Reader, u LogUser) (*ImportReport, error)
+}
+
+func (mm *mgoModelImpl) NewImporter(d DocInter, opts ImportOptions) Importer {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	return &importerImpl{
+		mm:   mm,
+		d:    d,
+		opts: opts,
+	}
+}
+
+type importerImpl struct {
+	mm   *mgoModelImpl
+	d    DocInter
+	opts ImportOptions
+}
+
+type importRow struct {
+	line int
+	doc  DocInter
+	// fields are the bson paths the row set, for ImportUpsert
+	fields []string
+}
+
+func (im *importerImpl) newDoc() DocInter {
+	return reflect.New(reflect.TypeOf(im.d).Elem()).Interface().(DocInter)
+}
+
+func (im *importerImpl) ImportCSV(r io.Reader, u LogUser) (*ImportReport, error) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return &ImportReport{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	header = append([]string{}, header...)
+	var setters []*csvColumn
+	var paths []string
+	if im.opts.Map == nil {
+		if setters, err = im.csvSetters(header); err != nil {
+			return nil, err
+		}
+		paths = make([]string, len(setters))
+		for i, c := range setters {
+			if c != nil {
+				paths[i], _ = bsonPath(reflect.TypeOf(im.d), c.path)
+			}
+		}
+	}
+	b := im.newBatch(u)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			b.report.Rows++
+			b.fail(pe.StartLine, err)
+			continue
+		}
+		if err != nil {
+			return b.report, err
+		}
+		b.report.Rows++
+		line, _ := cr.FieldPos(0)
+		d := im.newDoc()
+		var fields []string
+		if setters != nil {
+			err = setCSVRecord(d, setters, record)
+			for i, p := range paths {
+				if p != "" && i < len(record) && record[i] != "" {
+					fields = append(fields, p)
+				}
+			}
+		} else {
+			row := make(map[string]interface{}, len(header))
+			for i, h := range header {
+				if i < len(record) {
+					row[h] = record[i]
+				}
+			}
+			if err = im.opts.Map(row, d); err == nil {
+				fields, err = im.changedFields(d)
+			}
+		}
+		if err != nil {
+			b.fail(line, err)
+			continue
+		}
+		if err = b.add(line, d, fields); err != nil {
+			return b.report, err
+		}
+	}
+	return b.done()
+}
+
+func (im *importerImpl) ImportNDJSON(r io.Reader, u LogUser) (*ImportReport, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	b := im.newBatch(u)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := bytes.TrimSpace(sc.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		b.report.Rows++
+		d := im.newDoc()
+		var fields []string
+		var err error
+		if im.opts.Map != nil {
+			row := map[string]interface{}{}
+			if err = json.Unmarshal(text, &row); err == nil {
+				err = im.opts.Map(row, d)
+			}
+			if err == nil {
+				fields, err = im.changedFields(d)
+			}
+		} else if err = json.Unmarshal(text, d.GetDoc()); err == nil {
+			fields, err = im.jsonFields(text)
+		}
+		if err != nil {
+			b.fail(line, err)
+			continue
+		}
+		if err = b.add(line, d, fields); err != nil {
+			return b.report, err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return b.report, err
+	}
+	return b.done()
+}
+
+// csvSetters matches header cells to csv tagged columns, nil for unknown
+// headers.
+func (im *importerImpl) csvSetters(header []string) ([]*csvColumn, error) {
+	columns, err := csvColumns(reflect.TypeOf(im.d))
+	if err != nil {
+		return nil, err
+	}
+	byHeader := make(map[string]*csvColumn, len(columns))
+	for _, c := range columns {
+		byHeader[c.header] = c
+	}
+	setters := make([]*csvColumn, len(header))
+	for i, h := range header {
+		setters[i] = byHeader[strings.TrimSpace(h)]
+	}
+	return setters, nil
+}
+
+func setCSVRecord(d DocInter, setters []*csvColumn, record []string) error {
+	root := reflect.ValueOf(d)
+	for i, c := range setters {
+		if c == nil || i >= len(record) {
+			continue
+		}
+		if err := c.set(root, record[i]); err != nil {
+			return fmt.Errorf("%s: %w", c.header, err)
+		}
+	}
+	return nil
+}
+
+type importBatch struct {
+	im     *importerImpl
+	u      LogUser
+	rows   []importRow
+	report *ImportReport
+}
+
+func (im *importerImpl) newBatch(u LogUser) *importBatch {
+	return &importBatch{im: im, u: u, report: &ImportReport{}}
+}
+
+func (b *importBatch) fail(line int, err error) {
+	b.report.Errors = append(b.report.Errors, &ImportRowError{Line: line, Err: err})
+}
+
+// done writes the last rows and orders the errors by line.
+func (b *importBatch) done() (*ImportReport, error) {
+	err := b.flush()
+	sort.SliceStable(b.report.Errors, func(i, j int) bool {
+		return b.report.Errors[i].Line < b.report.Errors[j].Line
+	})
+	return b.report, err
+}
+
+func (b *importBatch) add(line int, d DocInter, fields []string) error {
+	if err := b.im.prepare(d); err != nil {
+		b.fail(line, err)
+		return nil
+	}
+	if b.im.opts.DryRun {
+		if err := validateDoc(d); err != nil {
+			b.fail(line, err)
+		} else {
+			b.report.Written++
+		}
+		return nil
+	}
+	b.rows = append(b.rows, importRow{line: line, doc: d, fields: fields})
+	if len(b.rows) < b.im.opts.BatchSize {
+		return nil
+	}
+	return b.flush()
+}
+
+// flush writes the pending rows.
+func (b *importBatch) flush() error {
+	if len(b.rows) == 0 {
+		return nil
+	}
+	rows := b.rows
+	b.rows = nil
+	if b.im.opts.Mode == ImportUpsert {
+		return b.upsert(rows)
+	}
+	lines := make(map[DocInter]int, len(rows))
+	docs := make([]DocInter, 0, len(rows))
+	for _, r := range rows {
+		lines[r.doc] = r.line
+		docs = append(docs, r.doc)
+	}
+	_, failed, err := b.im.mm.BatchSave(docs, b.u)
+	return b.written(docs, lines, failed, err)
+}
+
+// upsert writes the fields set by rows through BatchUpdate, the records
+// and version of existing docs are left to the model.
+func (b *importBatch) upsert(rows []importRow) error {
+	mm := b.im.mm
+	keys := b.im.opts.Key
+	lines := make(map[DocInter]int, len(rows))
+	fields := make(map[DocInter]bson.D, len(rows))
+	keyFilters := make(map[DocInter]bson.D)
+	docs := make([]DocInter, 0, len(rows))
+	for _, r := range rows {
+		doc, err := toBsonD(r.doc.GetDoc())
+		if err != nil {
+			b.fail(r.line, err)
+			continue
+		}
+		set := importSet(doc, r.fields)
+		if len(set) == 0 {
+			b.fail(r.line, errors.New("no field to import"))
+			continue
+		}
+		if len(keys) > 0 {
+			if keyFilters[r.doc], err = rowKeyFilter(doc, r.fields, keys); err != nil {
+				b.fail(r.line, err)
+				continue
+			}
+		}
+		lines[r.doc] = r.line
+		fields[r.doc] = set
+		docs = append(docs, r.doc)
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	if !mm.disableCheckBeforeSave {
+		if err := mm.CreateCollection(docs[0]); err != nil {
+			return err
+		}
+	}
+	if len(keys) > 0 {
+		var err error
+		if docs, err = b.matchKeys(docs, keyFilters, lines); err != nil || len(docs) == 0 {
+			return err
+		}
+	}
+	failed, err := mm.BatchUpdate(docs, func(d DocInter) bson.D {
+		return fields[d]
+	}, b.u)
+	return b.written(docs, lines, failed, err)
+}
+
+// written fails the rows of the docs BatchSave or BatchUpdate returned in
+// failed and counts the others.
+func (b *importBatch) written(docs []DocInter, lines map[DocInter]int, failed []DocInter, err error) error {
+	var excep mongo.BulkWriteException
+	if err != nil && !(errors.As(err, &excep) && excep.WriteConcernError == nil) {
+		return err
+	}
+	for _, de := range DocErrors(docs, failed, err) {
+		b.fail(lines[de.Doc], de.Err)
+	}
+	b.report.Written += len(docs) - len(failed)
+	return nil
+}
+
+// matchKeys gives docs the _id of the stored doc with the same Key fields,
+// docs sharing the keys of an earlier row in the batch take its _id.
+func (b *importBatch) matchKeys(docs []DocInter, keyFilters map[DocInter]bson.D, lines map[DocInter]int) ([]DocInter, error) {
+	mm := b.im.mm
+	or := make(bson.A, len(docs))
+	for i, d := range docs {
+		or[i] = keyFilters[d]
+	}
+	projection := bson.M{"_id": 1}
+	for _, k := range b.im.opts.Key {
+		projection[k] = 1
+	}
+	cursor, err := mm.db.Collection(docs[0].GetC()).Find(mm.ctx, bson.M{"$or": or}, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+	var stored []bson.D
+	if err = cursor.All(mm.ctx, &stored); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]interface{}, len(stored))
+	for _, doc := range stored {
+		k, err := keyFilter(doc, b.im.opts.Key)
+		if err != nil {
+			continue
+		}
+		if _, ok := ids[fmt.Sprint(k)]; !ok {
+			ids[fmt.Sprint(k)], _ = docGet(doc, "_id")
+		}
+	}
+	matched := docs[:0]
+	for _, d := range docs {
+		k := fmt.Sprint(keyFilters[d])
+		id, ok := ids[k]
+		if !ok {
+			ids[k] = d.GetID()
+			matched = append(matched, d)
+			continue
+		}
+		if err := setID(reflect.ValueOf(d), id); err != nil {
+			b.fail(lines[d], err)
+			continue
+		}
+		matched = append(matched, d)
+	}
+	return matched, nil
+}
+
+// rowKeyFilter matches the Key fields of doc, which the row must have set.
+func rowKeyFilter(doc bson.D, fields, keys []string) (bson.D, error) {
+	isSet := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		isSet[f] = true
+	}
+	for _, k := range keys {
+		found := false
+		for p := k; !found && p != ""; {
+			found = isSet[p]
+			if i := strings.LastIndex(p, "."); i >= 0 {
+				p = p[:i]
+			} else {
+				p = ""
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("key %s not set", k)
+		}
+	}
+	return keyFilter(doc, keys)
+}
+
+func keyFilter(doc bson.D, keys []string) (bson.D, error) {
+	filter := make(bson.D, 0, len(keys))
+	for _, k := range keys {
+		v, ok := lookupPath(doc, k)
+		if !ok || v == nil {
+			return nil, fmt.Errorf("key %s not set", k)
+		}
+		filter = append(filter, bson.E{Key: k, Value: v})
+	}
+	return filter, nil
+}
+
+// importSet picks the values of paths from doc, leaving out the _id and
+// the fields kept by the model.
+func importSet(doc bson.D, paths []string) bson.D {
+	set := make(bson.D, 0, len(paths))
+	seen := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		top, _, _ := strings.Cut(p, ".")
+		if seen[p] || top == "_id" || top == "records" || top == FieldVersion {
+			continue
+		}
+		seen[p] = true
+		if v, ok := lookupPath(doc, p); ok {
+			set = append(set, bson.E{Key: p, Value: v})
+		}
+	}
+	return set
+}
+
+// changedFields lists the top level bson fields of d differing from a new
+// doc, the fields Map set.
+func (im *importerImpl) changedFields(d DocInter) ([]string, error) {
+	if im.opts.Mode != ImportUpsert {
+		return nil, nil
+	}
+	fresh, err := toBsonD(im.newDoc().GetDoc())
+	if err != nil {
+		return nil, err
+	}
+	doc, err := toBsonD(d.GetDoc())
+	if err != nil {
+		return nil, err
+	}
+	var fields []string
+	for _, e := range doc {
+		if v, ok := docGet(fresh, e.Key); !ok || !valuesEqual(v, e.Value) {
+			fields = append(fields, e.Key)
+		}
+	}
+	return fields, nil
+}
+
+// jsonFields lists the bson fields decoded from the keys of an NDJSON
+// line.
+func (im *importerImpl) jsonFields(text []byte) ([]string, error) {
+	if im.opts.Mode != ImportUpsert {
+		return nil, nil
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(text, &keys); err != nil {
+		return nil, err
+	}
+	t := reflect.TypeOf(im.d.GetDoc())
+	byKey := jsonPaths(derefType(t), nil, map[string][]int{})
+	var fields []string
+	for k := range keys {
+		if path, ok := byKey[strings.ToLower(k)]; ok {
+			if p, ok := bsonPath(t, path); ok {
+				fields = append(fields, p)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// jsonPaths maps the lowercased JSON names of the fields of t to their
+// index path, fields of embedded structs are promoted as encoding/json
+// does unless a shallower field has the name.
+func jsonPaths(t reflect.Type, path []int, byKey map[string][]int) map[string][]int {
+	if t.Kind() != reflect.Struct {
+		return byKey
+	}
+	var embedded [][]int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		fieldPath := append(append([]int{}, path...), i)
+		if f.Anonymous && name == "" && derefType(f.Type).Kind() == reflect.Struct {
+			embedded = append(embedded, fieldPath)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if _, ok := byKey[strings.ToLower(name)]; !ok {
+			byKey[strings.ToLower(name)] = fieldPath
+		}
+	}
+	for _, p := range embedded {
+		jsonPaths(derefType(t.FieldByIndex(p[len(path):]).Type), p, byKey)
+	}
+	return byKey
+}
+
+// bsonPath returns the dotted bson key of the field at the index path
+// under t, the fields of inline structs sit in their parent. ok is false
+// for fields bson leaves out.
+func bsonPath(t reflect.Type, path []int) (string, bool) {
+	var keys []string
+	for _, i := range path {
+		t = derefType(t)
+		if t.Kind() != reflect.Struct {
+			return "", false
+		}
+		f := t.Field(i)
+		t = f.Type
+		if f.PkgPath != "" {
+			return "", false
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("bson"), ",")
+		if name == "-" {
+			return "", false
+		}
+		if name == "" && strings.Contains(opts, "inline") {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		keys = append(keys, name)
+	}
+	return strings.Join(keys, "."), len(keys) > 0
+}
+
+// prepare gives d a new ObjectID when its _id is zero, unless it is
+// upserted by _id which needs the one of the row.
+func (im *importerImpl) prepare(d DocInter) error {
+	byID := im.opts.Mode == ImportUpsert && len(im.opts.Key) == 0
+	if !byID {
+		if f := idField(reflect.ValueOf(d)); f.IsValid() && f.Type() == objectIDType && f.IsZero() {
+			f.Set(reflect.ValueOf(primitive.NewObjectID()))
+		}
+	}
+	if id := d.GetID(); id == nil || reflect.ValueOf(id).IsZero() {
+		if byID {
+			return errors.New("no _id to upsert on, set it or ImportOptions.Key")
+		}
+		return errors.New("no _id")
+	}
+	return nil
+}
+
+func setID(v reflect.Value, id interface{}) error {
+	f := idField(v)
+	if !f.IsValid() || id == nil || !reflect.TypeOf(id).AssignableTo(f.Type()) {
+		return fmt.Errorf("can not set _id %v", id)
+	}
+	f.Set(reflect.ValueOf(id))
+	return nil
+}
+
+// idField returns the settable _id field of v, looking into inline
+// structs, or the zero Value.
+func idField(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("bson"), ",")
+		switch {
+		case name == "_id":
+			if fv := v.Field(i); fv.CanSet() {
+				return fv
+			}
+			return reflect.Value{}
+		case name == "" && strings.Contains(opts, "inline"):
+			if fv := idField(v.Field(i)); fv.IsValid() {
+				return fv
+			}
+		}
+	}
+	return reflect.Value{}
+}
+
+// set parses s into the field of c under root, allocating nil pointers on
+// the way. Empty cells leave the field untouched.
+func (c *csvColumn) set(root reflect.Value, s string) error {
+	if s == "" {
+		return nil
+	}
+	v := root
+	for _, idx := range c.path {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return errors.New("nested slices can not be imported")
+		}
+		v = v.Field(idx)
+	}
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		parts := strings.Split(s, c.sep)
+		slice := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := c.parseInto(slice.Index(i), strings.TrimSpace(p)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	}
+	return c.parseInto(v, s)
+}
+
+func (c *csvColumn) parseInto(v reflect.Value, s string) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	for value, label := range c.enum {
+		if label == s {
+			s = value
+			break
+		}
+	}
+	switch v.Type() {
+	case timeType:
+		layout := c.layout
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		loc := c.loc
+		if loc == nil {
+			loc = time.UTC
+		}
+		t, err := time.ParseInLocation(layout, s, loc)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	case reflect.TypeOf(primitive.ObjectID{}):
+		id, err := primitive.ObjectIDFromHex(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(id))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Interface:
+		v.Set(reflect.ValueOf(s))
+	default:
+		return fmt.Errorf("can not import into %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,540 @@
+package morm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMemMgoModel returns a MgoDBModel backed by an in-memory database so
+// code taking a MgoDBModel can be unit tested without a running mongo.
+// Filters, updates and pipelines support the commonly used operators,
+// anything else fails with an "unsupported" error.
+func NewMemMgoModel(ctx context.Context) MgoDBModel {
+	return &mgoModelImpl{
+		db:  newMemDatabase(),
+		ctx: ctx,
+	}
+}
+
+func newMemDatabase() *memDatabase {
+	return &memDatabase{
+		collections: map[string]*memData{},
+	}
+}
+
+type memDatabase struct {
+	lock        sync.RWMutex
+	collections map[string]*memData
+}
+
+type memData struct {
+	docs []bson.D
+	ids  map[string]bool
+}
+
+// memWriteErr is a write error carrying the server error code mongo would
+// have returned, it is wrapped into WriteException or BulkWriteException.
+type memWriteErr struct {
+	code int
+	msg  string
+}
+
+func (e *memWriteErr) Error() string {
+	return e.msg
+}
+
+func toWriteException(err error) error {
+	if we, ok := err.(*memWriteErr); ok {
+		return mongo.WriteException{
+			WriteErrors: mongo.WriteErrors{{Code: we.code, Message: we.msg}},
+		}
+	}
+	return err
+}
+
+func ctxErr(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Err()
+}
+
+func (db *memDatabase) Collection(name string) mgoCollection {
+	return &memCollection{db: db, name: name}
+}
+
+func (db *memDatabase) ListCollectionNames(ctx context.Context, filter interface{}, opts ...*options.ListCollectionsOptions) ([]string, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	f, err := toBsonD(filter)
+	if err != nil {
+		return nil, err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	var names []string
+	for name := range db.collections {
+		ok, err := matchFilter(bson.D{{Key: "name", Value: name}}, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (db *memDatabase) CreateCollection(ctx context.Context, name string, opts ...*options.CreateCollectionOptions) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if _, ok := db.collections[name]; ok {
+		return mongo.CommandError{Code: 48, Name: "NamespaceExists", Message: "Collection already exists. NS: " + name}
+	}
+	db.data(name)
+	return nil
+}
+
+func (db *memDatabase) CreateIndexes(ctx context.Context, name string, models []mongo.IndexModel) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.data(name)
+	return nil
+}
+
+// data returns the collection storage, creating it like mongo does on the
+// first write. The caller must hold the write lock.
+func (db *memDatabase) data(name string) *memData {
+	c, ok := db.collections[name]
+	if !ok {
+		c = &memData{ids: map[string]bool{}}
+		db.collections[name] = c
+	}
+	return c
+}
+
+func idKey(id interface{}) string {
+	if typeRank(id) == 2 {
+		id = toFloat(id)
+	}
+	b, _ := bson.Marshal(bson.D{{Key: "v", Value: id}})
+	return string(b)
+}
+
+type memCollection struct {
+	db   *memDatabase
+	name string
+}
+
+// match returns the stored docs matching filter. The caller must hold the
+// read lock and must not modify the returned docs.
+func (mc *memCollection) match(filter bson.D) ([]bson.D, []int, error) {
+	c, ok := mc.db.collections[mc.name]
+	if !ok {
+		return nil, nil, nil
+	}
+	var docs []bson.D
+	var idx []int
+	for i, d := range c.docs {
+		ok, err := matchFilter(d, filter)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			docs = append(docs, d)
+			idx = append(idx, i)
+		}
+	}
+	return docs, idx, nil
+}
+
+func (mc *memCollection) query(ctx context.Context, filter interface{}, sortSpec interface{}, skip, limit *int64, projection interface{}) ([]bson.D, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	f, err := toBsonD(filter)
+	if err != nil {
+		return nil, err
+	}
+	mc.db.lock.RLock()
+	found, _, err := mc.match(f)
+	docs := make([]bson.D, len(found))
+	for i := range found {
+		docs[i] = copyDoc(found[i])
+	}
+	mc.db.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if sortSpec != nil {
+		s, err := toBsonD(sortSpec)
+		if err != nil {
+			return nil, err
+		}
+		if err = sortDocs(docs, s); err != nil {
+			return nil, err
+		}
+	}
+	var sk, li int64
+	if skip != nil {
+		sk = *skip
+	}
+	if limit != nil {
+		li = *limit
+	}
+	docs = skipLimit(docs, sk, li)
+	if projection != nil {
+		p, err := toBsonD(projection)
+		if err != nil {
+			return nil, err
+		}
+		if docs, err = mapDocs(docs, func(d bson.D) (bson.D, error) {
+			return projectDoc(d, p, false)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func newMemCursor(docs []bson.D) (*mongo.Cursor, error) {
+	list := make([]interface{}, len(docs))
+	for i := range docs {
+		list[i] = docs[i]
+	}
+	return mongo.NewCursorFromDocuments(list, nil, nil)
+}
+
+func (mc *memCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	fo := options.MergeFindOptions(opts...)
+	docs, err := mc.query(ctx, filter, fo.Sort, fo.Skip, fo.Limit, fo.Projection)
+	if err != nil {
+		return nil, err
+	}
+	return newMemCursor(docs)
+}
+
+func (mc *memCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	fo := options.MergeFindOneOptions(opts...)
+	one := int64(1)
+	docs, err := mc.query(ctx, filter, fo.Sort, fo.Skip, &one, fo.Projection)
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	if len(docs) == 0 {
+		return mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil)
+	}
+	return mongo.NewSingleResultFromDocument(docs[0], nil, nil)
+}
+
+func (mc *memCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	p, err := normalizeValue(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	stages, ok := p.(primitive.A)
+	if !ok && p != nil {
+		return nil, fmt.Errorf("pipeline must be an array of stages")
+	}
+	mc.db.lock.RLock()
+	defer mc.db.lock.RUnlock()
+	var docs []bson.D
+	if c, ok := mc.db.collections[mc.name]; ok {
+		docs = c.docs
+	}
+	docs, err = mc.db.runPipeline(docs, stages)
+	if err != nil {
+		return nil, err
+	}
+	return newMemCursor(docs)
+}
+
+func (mc *memCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	co := options.MergeCountOptions(opts...)
+	docs, err := mc.query(ctx, filter, nil, co.Skip, co.Limit, nil)
+	return int64(len(docs)), err
+}
+
+// insert stores doc and returns its _id. The caller must hold the write
+// lock.
+func (mc *memCollection) insert(document interface{}) (interface{}, error) {
+	doc, err := toBsonD(document)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := docGet(doc, "_id")
+	if !ok {
+		id = primitive.NewObjectID()
+		doc = append(bson.D{{Key: "_id", Value: id}}, doc...)
+	}
+	c := mc.db.data(mc.name)
+	key := idKey(id)
+	if c.ids[key] {
+		return nil, &memWriteErr{code: 11000, msg: fmt.Sprintf(
+			"E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %v }", mc.name, id)}
+	}
+	c.ids[key] = true
+	c.docs = append(c.docs, doc)
+	return id, nil
+}
+
+func (mc *memCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	mc.db.lock.Lock()
+	defer mc.db.lock.Unlock()
+	id, err := mc.insert(document)
+	if err != nil {
+		return nil, toWriteException(err)
+	}
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+func (mc *memCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	if len(documents) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+	models := make([]mongo.WriteModel, len(documents))
+	for i, d := range documents {
+		models[i] = mongo.NewInsertOneModel().SetDocument(d)
+	}
+	bo := options.BulkWrite()
+	if io := options.MergeInsertManyOptions(opts...); io.Ordered != nil {
+		bo.SetOrdered(*io.Ordered)
+	}
+	var ids []interface{}
+	_, err := mc.bulkWrite(models, bo, func(id interface{}) {
+		ids = append(ids, id)
+	})
+	return &mongo.InsertManyResult{InsertedIDs: ids}, err
+}
+
+// update applies update to the docs matching filter. The caller must hold
+// the write lock.
+func (mc *memCollection) update(filter, update interface{}, multi, upsert bool) (*mongo.UpdateResult, error) {
+	f, err := toBsonD(filter)
+	if err != nil {
+		return nil, err
+	}
+	u, err := toBsonD(update)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkUpdateDoc(u); err != nil {
+		return nil, err
+	}
+	_, idx, err := mc.match(f)
+	if err != nil {
+		return nil, err
+	}
+	result := &mongo.UpdateResult{}
+	if len(idx) == 0 {
+		if !upsert {
+			return result, nil
+		}
+		seed, err := upsertSeed(f)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := applyUpdate(seed, u, true)
+		if err != nil {
+			return nil, err
+		}
+		id, err := mc.insert(doc)
+		if err != nil {
+			return nil, err
+		}
+		result.UpsertedCount = 1
+		result.UpsertedID = id
+		return result, nil
+	}
+	if !multi {
+		idx = idx[:1]
+	}
+	c := mc.db.collections[mc.name]
+	for _, i := range idx {
+		doc, err := applyUpdate(c.docs[i], u, false)
+		if err != nil {
+			return result, err
+		}
+		oldID, _ := docGet(c.docs[i], "_id")
+		newID, _ := docGet(doc, "_id")
+		if !valuesEqual(oldID, newID) {
+			return result, &memWriteErr{code: 66, msg: "Performing an update on the path '_id' would modify the immutable field '_id'"}
+		}
+		result.MatchedCount++
+		if compareValues(doc, c.docs[i]) != 0 {
+			result.ModifiedCount++
+			c.docs[i] = doc
+		}
+	}
+	return result, nil
+}
+
+func (mc *memCollection) updateWith(ctx context.Context, filter, update interface{}, multi bool, opts []*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	uo := options.MergeUpdateOptions(opts...)
+	mc.db.lock.Lock()
+	defer mc.db.lock.Unlock()
+	result, err := mc.update(filter, update, multi, uo.Upsert != nil && *uo.Upsert)
+	return result, toWriteException(err)
+}
+
+func (mc *memCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return mc.updateWith(ctx, filter, update, false, opts)
+}
+
+func (mc *memCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return mc.updateWith(ctx, filter, update, true, opts)
+}
+
+// delete removes the docs matching filter. The caller must hold the write
+// lock.
+func (mc *memCollection) delete(filter interface{}, multi bool) (int64, error) {
+	f, err := toBsonD(filter)
+	if err != nil {
+		return 0, err
+	}
+	_, idx, err := mc.match(f)
+	if err != nil || len(idx) == 0 {
+		return 0, err
+	}
+	if !multi {
+		idx = idx[:1]
+	}
+	c := mc.db.collections[mc.name]
+	removed := map[int]bool{}
+	for _, i := range idx {
+		removed[i] = true
+		id, _ := docGet(c.docs[i], "_id")
+		delete(c.ids, idKey(id))
+	}
+	kept := make([]bson.D, 0, len(c.docs)-len(idx))
+	for i, d := range c.docs {
+		if !removed[i] {
+			kept = append(kept, d)
+		}
+	}
+	c.docs = kept
+	return int64(len(idx)), nil
+}
+
+func (mc *memCollection) deleteWith(ctx context.Context, filter interface{}, multi bool) (*mongo.DeleteResult, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	mc.db.lock.Lock()
+	defer mc.db.lock.Unlock()
+	n, err := mc.delete(filter, multi)
+	if err != nil {
+		return nil, err
+	}
+	return &mongo.DeleteResult{DeletedCount: n}, nil
+}
+
+func (mc *memCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return mc.deleteWith(ctx, filter, false)
+}
+
+func (mc *memCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return mc.deleteWith(ctx, filter, true)
+}
+
+func (mc *memCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	if len(models) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+	return mc.bulkWrite(models, options.MergeBulkWriteOptions(opts...), nil)
+}
+
+func (mc *memCollection) bulkWrite(models []mongo.WriteModel, bo *options.BulkWriteOptions, inserted func(id interface{})) (*mongo.BulkWriteResult, error) {
+	mc.db.lock.Lock()
+	defer mc.db.lock.Unlock()
+	ordered := bo.Ordered == nil || *bo.Ordered
+	result := &mongo.BulkWriteResult{UpsertedIDs: map[int64]interface{}{}}
+	var writeErrors []mongo.BulkWriteError
+	for i, m := range models {
+		var err error
+		switch t := m.(type) {
+		case *mongo.InsertOneModel:
+			var id interface{}
+			if id, err = mc.insert(t.Document); err == nil {
+				result.InsertedCount++
+				if inserted != nil {
+					inserted(id)
+				}
+			}
+		case *mongo.UpdateOneModel:
+			err = mc.bulkUpdate(result, int64(i), t.Filter, t.Update, false, t.Upsert)
+		case *mongo.UpdateManyModel:
+			err = mc.bulkUpdate(result, int64(i), t.Filter, t.Update, true, t.Upsert)
+		case *mongo.DeleteOneModel:
+			var n int64
+			n, err = mc.delete(t.Filter, false)
+			result.DeletedCount += n
+		case *mongo.DeleteManyModel:
+			var n int64
+			n, err = mc.delete(t.Filter, true)
+			result.DeletedCount += n
+		default:
+			err = fmt.Errorf("unsupported write model %T", m)
+		}
+		if err == nil {
+			continue
+		}
+		we, ok := err.(*memWriteErr)
+		if !ok {
+			return result, err
+		}
+		writeErrors = append(writeErrors, mongo.BulkWriteError{
+			WriteError: mongo.WriteError{Index: i, Code: we.code, Message: we.msg},
+			Request:    m,
+		})
+		if ordered {
+			break
+		}
+	}
+	if len(writeErrors) > 0 {
+		return result, mongo.BulkWriteException{WriteErrors: writeErrors}
+	}
+	return result, nil
+}
+
+func (mc *memCollection) bulkUpdate(result *mongo.BulkWriteResult, i int64, filter, update interface{}, multi bool, upsert *bool) error {
+	r, err := mc.update(filter, update, multi, upsert != nil && *upsert)
+	if err != nil {
+		return err
+	}
+	result.MatchedCount += r.MatchedCount
+	result.ModifiedCount += r.ModifiedCount
+	if r.UpsertedCount > 0 {
+		result.UpsertedCount += r.UpsertedCount
+		result.UpsertedIDs[i] = r.UpsertedID
+	}
+	return nil
+}
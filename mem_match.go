@@ -0,0 +1,440 @@
+package morm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// resolvePath returns every value reached by parts, descending into arrays
+// of documents the way mongo does for dotted filters.
+func resolvePath(v interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{v}
+	}
+	switch t := v.(type) {
+	case primitive.D:
+		sub, ok := docGet(t, parts[0])
+		if !ok {
+			return nil
+		}
+		return resolvePath(sub, parts[1:])
+	case primitive.A:
+		var result []interface{}
+		if i, err := strconv.Atoi(parts[0]); err == nil {
+			if i >= 0 && i < len(t) {
+				result = append(result, resolvePath(t[i], parts[1:])...)
+			}
+			return result
+		}
+		for _, e := range t {
+			if _, ok := e.(primitive.D); ok {
+				result = append(result, resolvePath(e, parts)...)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case primitive.MinKey:
+		return 0
+	case nil, primitive.Null, primitive.Undefined:
+		return 1
+	case int32, int64, float64, primitive.Decimal128:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case primitive.D:
+		return 4
+	case primitive.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.Regex:
+		return 11
+	case primitive.MaxKey:
+		return 13
+	}
+	return 12
+}
+
+func toFloat(v interface{}) float64 {
+	switch t := v.(type) {
+	case int32:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case float64:
+		return t
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(t.String(), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	}
+	return math.NaN()
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareValues orders two normalized values using mongo's cross type
+// ordering.
+func compareValues(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return compareInt(int64(ra), int64(rb))
+	}
+	switch x := a.(type) {
+	case int32, int64, float64, primitive.Decimal128:
+		fa, fb := toFloat(x), toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(x, fmt.Sprint(b))
+	case primitive.Symbol:
+		return strings.Compare(string(x), fmt.Sprint(b))
+	case primitive.D:
+		y := b.(primitive.D)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := strings.Compare(x[i].Key, y[i].Key); c != 0 {
+				return c
+			}
+			if c := compareValues(x[i].Value, y[i].Value); c != 0 {
+				return c
+			}
+		}
+		return compareInt(int64(len(x)), int64(len(y)))
+	case primitive.A:
+		y := b.(primitive.A)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compareValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInt(int64(len(x)), int64(len(y)))
+	case primitive.Binary:
+		return bytes.Compare(x.Data, b.(primitive.Binary).Data)
+	case primitive.ObjectID:
+		y := b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:])
+	case bool:
+		y := b.(bool)
+		if x == y {
+			return 0
+		}
+		if !x {
+			return -1
+		}
+		return 1
+	case primitive.DateTime:
+		return compareInt(int64(x), int64(b.(primitive.DateTime)))
+	case primitive.Timestamp:
+		y := b.(primitive.Timestamp)
+		if x.T != y.T {
+			return compareInt(int64(x.T), int64(y.T))
+		}
+		return compareInt(int64(x.I), int64(y.I))
+	case primitive.Regex:
+		y := b.(primitive.Regex)
+		return strings.Compare(x.Pattern+"/"+x.Options, y.Pattern+"/"+y.Options)
+	}
+	return 0
+}
+
+func valuesEqual(a, b interface{}) bool {
+	return typeRank(a) == typeRank(b) && compareValues(a, b) == 0
+}
+
+func isOperatorDoc(v interface{}) bool {
+	d, ok := v.(primitive.D)
+	return ok && len(d) > 0 && strings.HasPrefix(d[0].Key, "$")
+}
+
+// matchFilter reports whether doc satisfies a normalized filter.
+func matchFilter(doc bson.D, filter bson.D) (bool, error) {
+	for _, e := range filter {
+		ok, err := matchElem(doc, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchElem(doc bson.D, e primitive.E) (bool, error) {
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		subs, ok := e.Value.(primitive.A)
+		if !ok || len(subs) == 0 {
+			return false, fmt.Errorf("%s must be a nonempty array", e.Key)
+		}
+		for _, s := range subs {
+			sd, ok := s.(primitive.D)
+			if !ok {
+				return false, fmt.Errorf("%s entries must be documents", e.Key)
+			}
+			m, err := matchFilter(doc, sd)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case e.Key == "$and" && !m:
+				return false, nil
+			case e.Key == "$or" && m:
+				return true, nil
+			case e.Key == "$nor" && m:
+				return false, nil
+			}
+		}
+		return e.Key != "$or", nil
+	case "$comment":
+		return true, nil
+	}
+	if strings.HasPrefix(e.Key, "$") {
+		return false, fmt.Errorf("unsupported top level operator: %s", e.Key)
+	}
+	values := resolvePath(doc, strings.Split(e.Key, "."))
+	if isOperatorDoc(e.Value) {
+		return matchOperators(values, e.Value.(primitive.D))
+	}
+	return matchEq(values, e.Value)
+}
+
+// matchEq implements implicit equality including array membership and
+// regular expression values.
+func matchEq(values []interface{}, want interface{}) (bool, error) {
+	if re, ok := want.(primitive.Regex); ok {
+		return matchRegex(values, re.Pattern, re.Options)
+	}
+	if len(values) == 0 {
+		return want == nil || typeRank(want) == 1, nil
+	}
+	for _, v := range values {
+		if valuesEqual(v, want) {
+			return true, nil
+		}
+		if a, ok := v.(primitive.A); ok {
+			for _, item := range a {
+				if valuesEqual(item, want) {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+func matchCompare(values []interface{}, want interface{}, accept func(c int) bool) bool {
+	for _, v := range values {
+		candidates := []interface{}{v}
+		if a, ok := v.(primitive.A); ok {
+			candidates = append(candidates, a...)
+		}
+		for _, c := range candidates {
+			if typeRank(c) == typeRank(want) && accept(compareValues(c, want)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchRegex(values []interface{}, pattern, opts string) (bool, error) {
+	flags := ""
+	for _, o := range opts {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		case 'x':
+		default:
+			return false, fmt.Errorf("unsupported regex option: %c", o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range values {
+		candidates := []interface{}{v}
+		if a, ok := v.(primitive.A); ok {
+			candidates = a
+		}
+		for _, c := range candidates {
+			if s, ok := c.(string); ok && re.MatchString(s) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func matchOperators(values []interface{}, ops primitive.D) (bool, error) {
+	for _, op := range ops {
+		ok, err := matchOperator(values, op, ops)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(values []interface{}, op primitive.E, all primitive.D) (bool, error) {
+	switch op.Key {
+	case "$eq":
+		return matchEq(values, op.Value)
+	case "$ne":
+		m, err := matchEq(values, op.Value)
+		return !m, err
+	case "$gt":
+		return matchCompare(values, op.Value, func(c int) bool { return c > 0 }), nil
+	case "$gte":
+		return matchCompare(values, op.Value, func(c int) bool { return c >= 0 }), nil
+	case "$lt":
+		return matchCompare(values, op.Value, func(c int) bool { return c < 0 }), nil
+	case "$lte":
+		return matchCompare(values, op.Value, func(c int) bool { return c <= 0 }), nil
+	case "$in", "$nin":
+		list, ok := op.Value.(primitive.A)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", op.Key)
+		}
+		found := false
+		for _, want := range list {
+			m, err := matchEq(values, want)
+			if err != nil {
+				return false, err
+			}
+			if m {
+				found = true
+				break
+			}
+		}
+		return found == (op.Key == "$in"), nil
+	case "$exists":
+		want := truthy(op.Value)
+		return (len(values) > 0) == want, nil
+	case "$regex":
+		opts, _ := docGet(all, "$options")
+		switch t := op.Value.(type) {
+		case string:
+			o, _ := opts.(string)
+			return matchRegex(values, t, o)
+		case primitive.Regex:
+			return matchRegex(values, t.Pattern, t.Options)
+		}
+		return false, fmt.Errorf("$regex has to be a string")
+	case "$options":
+		return true, nil
+	case "$not":
+		var m bool
+		var err error
+		switch t := op.Value.(type) {
+		case primitive.D:
+			m, err = matchOperators(values, t)
+		case primitive.Regex:
+			m, err = matchRegex(values, t.Pattern, t.Options)
+		default:
+			return false, fmt.Errorf("$not needs a regex or a document")
+		}
+		return !m, err
+	case "$size":
+		n := toFloat(op.Value)
+		for _, v := range values {
+			if a, ok := v.(primitive.A); ok && float64(len(a)) == n {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$all":
+		list, ok := op.Value.(primitive.A)
+		if !ok {
+			return false, fmt.Errorf("$all needs an array")
+		}
+		for _, want := range list {
+			m, err := matchEq(values, want)
+			if err != nil || !m {
+				return false, err
+			}
+		}
+		return len(list) > 0, nil
+	case "$elemMatch":
+		cond, ok := op.Value.(primitive.D)
+		if !ok {
+			return false, fmt.Errorf("$elemMatch needs an Object")
+		}
+		for _, v := range values {
+			a, ok := v.(primitive.A)
+			if !ok {
+				continue
+			}
+			for _, item := range a {
+				var m bool
+				var err error
+				if isOperatorDoc(cond) {
+					m, err = matchOperators([]interface{}{item}, cond)
+				} else if sub, ok := item.(primitive.D); ok {
+					m, err = matchFilter(sub, cond)
+				}
+				if err != nil {
+					return false, err
+				}
+				if m {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unsupported operator: %s", op.Key)
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return false
+	case bool:
+		return t
+	case int32, int64, float64, primitive.Decimal128:
+		return toFloat(t) != 0
+	}
+	return true
+}
+
+func nowDateTime() primitive.DateTime {
+	return primitive.NewDateTimeFromTime(time.Now())
+}
@@ -0,0 +1,523 @@
+package morm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func sortDocs(docs []bson.D, spec bson.D) error {
+	for _, s := range spec {
+		if d, ok := s.Value.(primitive.D); ok {
+			return fmt.Errorf("unsupported sort on %s: %v", s.Key, d)
+		}
+		if n := toFloat(s.Value); n != 1 && n != -1 {
+			return fmt.Errorf("invalid sort order on %s: %v", s.Key, s.Value)
+		}
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, s := range spec {
+			a, _ := lookupPath(docs[i], s.Key)
+			b, _ := lookupPath(docs[j], s.Key)
+			c := compareValues(a, b)
+			if toFloat(s.Value) < 0 {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+func skipLimit(docs []bson.D, skip, limit int64) []bson.D {
+	if skip > 0 {
+		if skip >= int64(len(docs)) {
+			return nil
+		}
+		docs = docs[skip:]
+	}
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < int64(len(docs)) {
+		docs = docs[:limit]
+	}
+	return docs
+}
+
+// projectDoc applies a find projection or, with exprs set, a $project
+// stage whose values may be field paths and literals.
+func projectDoc(doc bson.D, spec bson.D, exprs bool) (bson.D, error) {
+	include := false
+	keepID := true
+	for _, s := range spec {
+		if s.Key == "_id" {
+			if isFlag(s.Value) && !truthy(s.Value) {
+				keepID = false
+			}
+			continue
+		}
+		if !isFlag(s.Value) || truthy(s.Value) {
+			include = true
+		}
+	}
+	if len(spec) == 1 && spec[0].Key == "_id" && keepID {
+		// {_id: 1} alone keeps only the _id
+		include = true
+	}
+	if !include {
+		result := copyDoc(doc)
+		for _, s := range spec {
+			if s.Key != "_id" || !keepID {
+				result = unsetDocPath(result, s.Key)
+			}
+		}
+		return result, nil
+	}
+	result := bson.D{}
+	var err error
+	if id, ok := docGet(doc, "_id"); ok && keepID {
+		result = append(result, primitive.E{Key: "_id", Value: id})
+	}
+	for _, s := range spec {
+		if s.Key == "_id" && isFlag(s.Value) {
+			continue
+		}
+		var v interface{}
+		var ok bool
+		if isFlag(s.Value) {
+			if !truthy(s.Value) {
+				return nil, fmt.Errorf("cannot do exclusion on field %s in inclusion projection", s.Key)
+			}
+			v, ok = lookupPath(doc, s.Key)
+		} else {
+			if !exprs {
+				return nil, fmt.Errorf("unsupported projection on %s", s.Key)
+			}
+			v, ok, err = evalExpr(doc, s.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !ok {
+			continue
+		}
+		if result, err = setDocPath(result, s.Key, copyValue(v)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func isFlag(v interface{}) bool {
+	switch v.(type) {
+	case bool, int32, int64, float64:
+		return true
+	}
+	return false
+}
+
+// evalExpr evaluates the aggregation expressions the in-memory backend
+// understands: "$field.path" references, $literal and plain values.
+func evalExpr(doc bson.D, expr interface{}) (interface{}, bool, error) {
+	switch t := expr.(type) {
+	case string:
+		if strings.HasPrefix(t, "$$") {
+			return nil, false, fmt.Errorf("unsupported variable: %s", t)
+		}
+		if strings.HasPrefix(t, "$") {
+			v, ok := lookupPath(doc, t[1:])
+			if !ok {
+				if vals := resolvePath(doc, strings.Split(t[1:], ".")); len(vals) > 0 {
+					return primitive.A(vals), true, nil
+				}
+			}
+			return v, ok, nil
+		}
+		return t, true, nil
+	case primitive.D:
+		if isOperatorDoc(t) {
+			if len(t) == 1 && t[0].Key == "$literal" {
+				return t[0].Value, true, nil
+			}
+			return nil, false, fmt.Errorf("unsupported expression operator: %s", t[0].Key)
+		}
+		result := primitive.D{}
+		for _, e := range t {
+			v, ok, err := evalExpr(doc, e.Value)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				result = append(result, primitive.E{Key: e.Key, Value: v})
+			}
+		}
+		return result, true, nil
+	case primitive.A:
+		result := primitive.A{}
+		for _, e := range t {
+			v, _, err := evalExpr(doc, e)
+			if err != nil {
+				return nil, false, err
+			}
+			result = append(result, v)
+		}
+		return result, true, nil
+	}
+	return expr, true, nil
+}
+
+// runPipeline executes the supported aggregation stages. The caller must
+// hold the database lock since $lookup reads other collections.
+func (db *memDatabase) runPipeline(docs []bson.D, pipeline primitive.A) ([]bson.D, error) {
+	for _, st := range pipeline {
+		stage, ok := st.(primitive.D)
+		if !ok || len(stage) != 1 {
+			return nil, fmt.Errorf("a pipeline stage specification object must contain exactly one field")
+		}
+		var err error
+		docs, err = db.runStage(docs, stage[0].Key, stage[0].Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func (db *memDatabase) runStage(docs []bson.D, name string, arg interface{}) ([]bson.D, error) {
+	spec, _ := arg.(primitive.D)
+	switch name {
+	case "$match":
+		var result []bson.D
+		for _, d := range docs {
+			ok, err := matchFilter(d, spec)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				result = append(result, d)
+			}
+		}
+		return result, nil
+	case "$sort":
+		docs = append([]bson.D{}, docs...)
+		return docs, sortDocs(docs, spec)
+	case "$skip":
+		return skipLimit(docs, int64(toFloat(arg)), 0), nil
+	case "$limit":
+		return skipLimit(docs, 0, int64(toFloat(arg))), nil
+	case "$count":
+		field, _ := arg.(string)
+		if field == "" {
+			return nil, fmt.Errorf("the count field must be a non-empty string")
+		}
+		if len(docs) == 0 {
+			return nil, nil
+		}
+		return []bson.D{{{Key: field, Value: int32(len(docs))}}}, nil
+	case "$project":
+		return mapDocs(docs, func(d bson.D) (bson.D, error) {
+			return projectDoc(d, spec, true)
+		})
+	case "$unset":
+		fields := primitive.A{arg}
+		if a, ok := arg.(primitive.A); ok {
+			fields = a
+		}
+		return mapDocs(docs, func(d bson.D) (bson.D, error) {
+			d = copyDoc(d)
+			for _, f := range fields {
+				if s, ok := f.(string); ok {
+					d = unsetDocPath(d, s)
+				}
+			}
+			return d, nil
+		})
+	case "$addFields", "$set":
+		return mapDocs(docs, func(d bson.D) (bson.D, error) {
+			d = copyDoc(d)
+			for _, e := range spec {
+				v, ok, err := evalExpr(d, e.Value)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+				if d, err = setDocPath(d, e.Key, v); err != nil {
+					return nil, err
+				}
+			}
+			return d, nil
+		})
+	case "$replaceRoot", "$replaceWith":
+		expr := arg
+		if name == "$replaceRoot" {
+			expr, _ = docGet(spec, "newRoot")
+		}
+		return mapDocs(docs, func(d bson.D) (bson.D, error) {
+			v, _, err := evalExpr(d, expr)
+			if err != nil {
+				return nil, err
+			}
+			root, ok := v.(primitive.D)
+			if !ok {
+				return nil, fmt.Errorf("'newRoot' expression must evaluate to an object")
+			}
+			return root, nil
+		})
+	case "$unwind":
+		return unwindDocs(docs, arg)
+	case "$group":
+		return groupDocs(docs, spec)
+	case "$lookup":
+		return db.lookupDocs(docs, spec)
+	case "$facet":
+		facet := bson.D{}
+		for _, e := range spec {
+			sub, ok := e.Value.(primitive.A)
+			if !ok {
+				return nil, fmt.Errorf("$facet %s must be an array of stages", e.Key)
+			}
+			result, err := db.runPipeline(docs, sub)
+			if err != nil {
+				return nil, err
+			}
+			rows := primitive.A{}
+			for _, r := range result {
+				rows = append(rows, r)
+			}
+			facet = append(facet, primitive.E{Key: e.Key, Value: rows})
+		}
+		return []bson.D{facet}, nil
+	}
+	return nil, fmt.Errorf("unsupported pipeline stage: %s", name)
+}
+
+func mapDocs(docs []bson.D, f func(d bson.D) (bson.D, error)) ([]bson.D, error) {
+	result := make([]bson.D, 0, len(docs))
+	for _, d := range docs {
+		nd, err := f(d)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, nd)
+	}
+	return result, nil
+}
+
+func unwindDocs(docs []bson.D, arg interface{}) ([]bson.D, error) {
+	path, _ := arg.(string)
+	preserve := false
+	indexField := ""
+	if spec, ok := arg.(primitive.D); ok {
+		p, _ := docGet(spec, "path")
+		path, _ = p.(string)
+		if v, ok := docGet(spec, "preserveNullAndEmptyArrays"); ok {
+			preserve = truthy(v)
+		}
+		if v, ok := docGet(spec, "includeArrayIndex"); ok {
+			indexField, _ = v.(string)
+		}
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("$unwind path must be prefixed by a '$'")
+	}
+	path = path[1:]
+	var result []bson.D
+	for _, d := range docs {
+		v, ok := lookupPath(d, path)
+		arr, isArr := v.(primitive.A)
+		if !ok || v == nil || (isArr && len(arr) == 0) {
+			if preserve && isArr {
+				// an empty array is dropped, null is kept
+				result = append(result, unsetDocPath(copyDoc(d), path))
+			} else if preserve {
+				result = append(result, d)
+			}
+			continue
+		}
+		if !isArr {
+			result = append(result, d)
+			continue
+		}
+		for i, item := range arr {
+			nd, err := setDocPath(copyDoc(d), path, copyValue(item))
+			if err != nil {
+				return nil, err
+			}
+			if indexField != "" {
+				nd = append(nd, primitive.E{Key: indexField, Value: int64(i)})
+			}
+			result = append(result, nd)
+		}
+	}
+	return result, nil
+}
+
+type memGroup struct {
+	id   interface{}
+	docs []bson.D
+}
+
+func groupDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	idExpr, ok := docGet(spec, "_id")
+	if !ok {
+		return nil, fmt.Errorf("a group specification must include an _id")
+	}
+	var groups []*memGroup
+	for _, d := range docs {
+		id, _, err := evalExpr(d, idExpr)
+		if err != nil {
+			return nil, err
+		}
+		var g *memGroup
+		for _, eg := range groups {
+			if valuesEqual(eg.id, id) {
+				g = eg
+				break
+			}
+		}
+		if g == nil {
+			g = &memGroup{id: id}
+			groups = append(groups, g)
+		}
+		g.docs = append(g.docs, d)
+	}
+	var result []bson.D
+	for _, g := range groups {
+		row := bson.D{{Key: "_id", Value: g.id}}
+		for _, e := range spec {
+			if e.Key == "_id" {
+				continue
+			}
+			acc, ok := e.Value.(primitive.D)
+			if !ok || len(acc) != 1 {
+				return nil, fmt.Errorf("the field '%s' must be an accumulator object", e.Key)
+			}
+			v, err := accumulate(g.docs, acc[0].Key, acc[0].Value)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, primitive.E{Key: e.Key, Value: v})
+		}
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+func accumulate(docs []bson.D, op string, expr interface{}) (interface{}, error) {
+	var values []interface{}
+	for _, d := range docs {
+		v, ok, err := evalExpr(d, expr)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values = append(values, v)
+		}
+	}
+	switch op {
+	case "$sum", "$avg":
+		var sum interface{} = int32(0)
+		n := 0
+		for _, v := range values {
+			if typeRank(v) != 2 {
+				continue
+			}
+			sum, _ = addNumbers(sum, v)
+			n++
+		}
+		if op == "$sum" {
+			return sum, nil
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		return toFloat(sum) / float64(n), nil
+	case "$count":
+		return int32(len(docs)), nil
+	case "$min", "$max":
+		var best interface{}
+		for _, v := range values {
+			if v == nil {
+				continue
+			}
+			c := compareValues(v, best)
+			if best == nil || (op == "$min" && c < 0) || (op == "$max" && c > 0) {
+				best = v
+			}
+		}
+		return best, nil
+	case "$first", "$last":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		if op == "$first" {
+			return values[0], nil
+		}
+		return values[len(values)-1], nil
+	case "$push", "$addToSet":
+		arr := primitive.A{}
+		for _, v := range values {
+			if op == "$addToSet" {
+				if m, _ := matchEq([]interface{}{arr}, v); m {
+					continue
+				}
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("unsupported accumulator: %s", op)
+}
+
+func (db *memDatabase) lookupDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	get := func(k string) string {
+		v, _ := docGet(spec, k)
+		s, _ := v.(string)
+		return s
+	}
+	from, local, foreign, as := get("from"), get("localField"), get("foreignField"), get("as")
+	if from == "" || local == "" || foreign == "" || as == "" {
+		return nil, fmt.Errorf("$lookup needs from, localField, foreignField and as")
+	}
+	var foreignDocs []bson.D
+	if c, ok := db.collections[from]; ok {
+		foreignDocs = c.docs
+	}
+	return mapDocs(docs, func(d bson.D) (bson.D, error) {
+		locals := resolvePath(d, strings.Split(local, "."))
+		if len(locals) == 0 {
+			locals = []interface{}{nil}
+		}
+		matched := primitive.A{}
+		for _, fd := range foreignDocs {
+			values := resolvePath(fd, strings.Split(foreign, "."))
+			for _, lv := range locals {
+				candidates := []interface{}{lv}
+				if a, ok := lv.(primitive.A); ok {
+					candidates = a
+				}
+				found := false
+				for _, c := range candidates {
+					if m, _ := matchEq(values, c); m {
+						found = true
+						break
+					}
+				}
+				if found {
+					matched = append(matched, copyDoc(fd))
+					break
+				}
+			}
+		}
+		return setDocPath(copyDoc(d), as, matched)
+	})
+}
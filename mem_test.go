@@ -0,0 +1,342 @@
+package morm
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// memSeed returns a mem database holding docs in the collections of the
+// map.
+func memSeed(t *testing.T, colls map[string][]interface{}) *memDatabase {
+	t.Helper()
+	db := newMemDatabase()
+	for name, docs := range colls {
+		if _, err := db.Collection(name).InsertMany(context.Background(), docs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// sameDocs compares documents after a round trip through bson so that the
+// numeric and document types of both sides match.
+func sameDocs(t *testing.T, got, want interface{}) bool {
+	t.Helper()
+	norm := func(v interface{}) bson.M {
+		b, err := bson.Marshal(bson.M{"v": v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := bson.M{}
+		if err = bson.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	return reflect.DeepEqual(norm(got), norm(want))
+}
+
+func readAll(t *testing.T, cur *mongo.Cursor, err error) []bson.M {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := []bson.M{}
+	if err = cur.All(context.Background(), &docs); err != nil {
+		t.Fatal(err)
+	}
+	return docs
+}
+
+func TestMemMatch(t *testing.T) {
+	db := memSeed(t, map[string][]interface{}{"c": {
+		bson.M{"_id": 1, "name": "amy", "age": 30, "tags": bson.A{"a", "b"}, "addr": bson.M{"city": "tp"}},
+		bson.M{"_id": 2, "name": "bob", "age": 20, "tags": bson.A{"b"}, "deletedAt": nil},
+		bson.M{"_id": 3, "name": "Cat", "age": 40.5, "items": bson.A{bson.M{"n": 1, "ok": true}, bson.M{"n": 5, "ok": false}}},
+		bson.M{"_id": 4, "age": "old"},
+	}})
+	tests := []struct {
+		name   string
+		filter bson.M
+		want   []int
+	}{
+		{"empty", bson.M{}, []int{1, 2, 3, 4}},
+		{"eq", bson.M{"name": "bob"}, []int{2}},
+		{"eq array element", bson.M{"tags": "b"}, []int{1, 2}},
+		{"eq dotted", bson.M{"addr.city": "tp"}, []int{1}},
+		{"eq nil missing", bson.M{"deletedAt": nil}, []int{1, 2, 3, 4}},
+		{"ne", bson.M{"name": bson.M{"$ne": "amy"}}, []int{2, 3, 4}},
+		{"gt mixed numbers", bson.M{"age": bson.M{"$gt": 25}}, []int{1, 3}},
+		{"gte lte", bson.M{"age": bson.M{"$gte": 20, "$lte": 30}}, []int{1, 2}},
+		{"lt skips other types", bson.M{"age": bson.M{"$lt": 100}}, []int{1, 2, 3}},
+		{"in", bson.M{"name": bson.M{"$in": bson.A{"amy", "Cat"}}}, []int{1, 3}},
+		{"nin", bson.M{"name": bson.M{"$nin": bson.A{"amy", "Cat"}}}, []int{2, 4}},
+		{"exists", bson.M{"tags": bson.M{"$exists": true}}, []int{1, 2}},
+		{"not exists", bson.M{"name": bson.M{"$exists": false}}, []int{4}},
+		{"regex", bson.M{"name": bson.M{"$regex": "^c", "$options": "i"}}, []int{3}},
+		{"not", bson.M{"name": bson.M{"$not": bson.M{"$regex": "^a"}}}, []int{2, 3, 4}},
+		{"size", bson.M{"tags": bson.M{"$size": 2}}, []int{1}},
+		{"all", bson.M{"tags": bson.M{"$all": bson.A{"a", "b"}}}, []int{1}},
+		{"elemMatch", bson.M{"items": bson.M{"$elemMatch": bson.M{"n": bson.M{"$gt": 2}, "ok": false}}}, []int{3}},
+		{"and", bson.M{"$and": bson.A{bson.M{"tags": "b"}, bson.M{"age": bson.M{"$lt": 25}}}}, []int{2}},
+		{"or", bson.M{"$or": bson.A{bson.M{"name": "amy"}, bson.M{"age": "old"}}}, []int{1, 4}},
+		{"nor", bson.M{"$nor": bson.A{bson.M{"name": "amy"}, bson.M{"age": "old"}}}, []int{2, 3}},
+		{"empty in", bson.M{"_id": bson.M{"$in": bson.A{}}}, nil},
+	}
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+	for _, tt := range tests {
+		cur, err := db.Collection("c").Find(context.Background(), tt.filter, opts)
+		var ids []int
+		for _, d := range readAll(t, cur, err) {
+			ids = append(ids, int(d["_id"].(int32)))
+		}
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, ids, tt.want)
+		}
+	}
+}
+
+func TestMemUpdate(t *testing.T) {
+	doc := bson.M{"_id": 1, "n": 5, "s": "x", "list": bson.A{1, 2, 3}, "sub": bson.M{"a": 1}}
+	tests := []struct {
+		name   string
+		update bson.M
+		upsert bool
+		filter bson.M
+		want   bson.M
+	}{
+		{
+			name:   "set nested",
+			update: bson.M{"$set": bson.M{"s": "y", "sub.b": 2}},
+			want:   bson.M{"_id": 1, "n": 5, "s": "y", "list": bson.A{1, 2, 3}, "sub": bson.M{"a": 1, "b": 2}},
+		},
+		{
+			name:   "unset",
+			update: bson.M{"$unset": bson.M{"s": "", "sub.a": ""}},
+			want:   bson.M{"_id": 1, "n": 5, "list": bson.A{1, 2, 3}, "sub": bson.M{}},
+		},
+		{
+			name:   "inc existing and missing",
+			update: bson.M{"$inc": bson.M{"n": 2, "m": 1}},
+			want:   bson.M{"_id": 1, "n": 7, "m": 1, "s": "x", "list": bson.A{1, 2, 3}, "sub": bson.M{"a": 1}},
+		},
+		{
+			name:   "min max",
+			update: bson.M{"$min": bson.M{"n": 3}, "$max": bson.M{"sub.a": 0}},
+			want:   bson.M{"_id": 1, "n": 3, "s": "x", "list": bson.A{1, 2, 3}, "sub": bson.M{"a": 1}},
+		},
+		{
+			name:   "rename",
+			update: bson.M{"$rename": bson.M{"s": "t"}},
+			want:   bson.M{"_id": 1, "n": 5, "t": "x", "list": bson.A{1, 2, 3}, "sub": bson.M{"a": 1}},
+		},
+		{
+			name:   "push each",
+			update: bson.M{"$push": bson.M{"list": bson.M{"$each": bson.A{4, 5}}, "new": "a"}},
+			want:   bson.M{"_id": 1, "n": 5, "s": "x", "list": bson.A{1, 2, 3, 4, 5}, "new": bson.A{"a"}, "sub": bson.M{"a": 1}},
+		},
+		{
+			name:   "addToSet",
+			update: bson.M{"$addToSet": bson.M{"list": bson.M{"$each": bson.A{3, 4}}}},
+			want:   bson.M{"_id": 1, "n": 5, "s": "x", "list": bson.A{1, 2, 3, 4}, "sub": bson.M{"a": 1}},
+		},
+		{
+			name:   "pull",
+			update: bson.M{"$pull": bson.M{"list": bson.M{"$gte": 2}}},
+			want:   bson.M{"_id": 1, "n": 5, "s": "x", "list": bson.A{1}, "sub": bson.M{"a": 1}},
+		},
+		{
+			name:   "setOnInsert ignored on update",
+			update: bson.M{"$setOnInsert": bson.M{"s": "y"}},
+			want:   doc,
+		},
+		{
+			name:   "upsert from filter",
+			update: bson.M{"$set": bson.M{"n": 1}, "$setOnInsert": bson.M{"s": "new"}},
+			upsert: true,
+			filter: bson.M{"_id": 2, "k": "v"},
+			want:   bson.M{"_id": 2, "k": "v", "n": 1, "s": "new"},
+		},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		coll := memSeed(t, map[string][]interface{}{"c": {doc}}).Collection("c")
+		filter := tt.filter
+		if filter == nil {
+			filter = bson.M{"_id": 1}
+		}
+		_, err := coll.UpdateOne(ctx, filter, tt.update, options.Update().SetUpsert(tt.upsert))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := bson.M{}
+		if err = coll.FindOne(ctx, bson.M{"_id": filter["_id"]}).Decode(&got); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !sameDocs(t, got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemUpdateErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		update bson.M
+	}{
+		{"no operator", bson.M{"n": 1}},
+		{"unknown operator", bson.M{"$bogus": bson.M{"n": 1}}},
+		{"inc not a number", bson.M{"$inc": bson.M{"s": 1}}},
+		{"push not an array", bson.M{"$push": bson.M{"n": 1}}},
+		{"conflicting paths", bson.M{"$set": bson.M{"sub": 1}, "$unset": bson.M{"sub.a": ""}}},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		coll := memSeed(t, map[string][]interface{}{"c": {
+			bson.M{"_id": 1, "n": 5, "s": "x", "sub": bson.M{"a": 1}},
+		}}).Collection("c")
+		if _, err := coll.UpdateOne(ctx, bson.M{"_id": 1}, tt.update); err == nil {
+			t.Errorf("%s: want an error", tt.name)
+		}
+	}
+}
+
+func TestMemPipeline(t *testing.T) {
+	db := memSeed(t, map[string][]interface{}{
+		"orders": {
+			bson.M{"_id": 1, "user": "u1", "qty": 2, "items": bson.A{"a", "b"}},
+			bson.M{"_id": 2, "user": "u2", "qty": 5, "items": bson.A{"c"}},
+			bson.M{"_id": 3, "user": "u1", "qty": 1, "items": bson.A{}},
+		},
+		"users": {
+			bson.M{"_id": "u1", "name": "amy"},
+			bson.M{"_id": "u2", "name": "bob"},
+		},
+	})
+	tests := []struct {
+		name     string
+		pipeline bson.A
+		want     []bson.M
+	}{
+		{
+			name:     "match sort",
+			pipeline: bson.A{bson.M{"$match": bson.M{"user": "u1"}}, bson.M{"$sort": bson.M{"qty": -1}}, bson.M{"$project": bson.M{"qty": 1}}},
+			want:     []bson.M{{"_id": 1, "qty": 2}, {"_id": 3, "qty": 1}},
+		},
+		{
+			name:     "skip limit",
+			pipeline: bson.A{bson.M{"$sort": bson.M{"_id": 1}}, bson.M{"$skip": 1}, bson.M{"$limit": 1}, bson.M{"$project": bson.M{"_id": 1}}},
+			want:     []bson.M{{"_id": 2}},
+		},
+		{
+			name:     "count",
+			pipeline: bson.A{bson.M{"$match": bson.M{"qty": bson.M{"$gt": 1}}}, bson.M{"$count": "n"}},
+			want:     []bson.M{{"n": 2}},
+		},
+		{
+			name: "addFields unset",
+			pipeline: bson.A{
+				bson.M{"$match": bson.M{"_id": 2}},
+				bson.M{"$addFields": bson.M{"total": "$qty", "fixed": "x"}},
+				bson.M{"$unset": bson.A{"items", "user"}},
+			},
+			want: []bson.M{{"_id": 2, "qty": 5, "total": 5, "fixed": "x"}},
+		},
+		{
+			name: "unwind",
+			pipeline: bson.A{
+				bson.M{"$unwind": "$items"},
+				bson.M{"$project": bson.M{"items": 1}},
+			},
+			want: []bson.M{{"_id": 1, "items": "a"}, {"_id": 1, "items": "b"}, {"_id": 2, "items": "c"}},
+		},
+		{
+			name: "unwind preserve",
+			pipeline: bson.A{
+				bson.M{"$match": bson.M{"_id": 3}},
+				bson.M{"$unwind": bson.M{"path": "$items", "preserveNullAndEmptyArrays": true}},
+				bson.M{"$project": bson.M{"items": 1}},
+			},
+			want: []bson.M{{"_id": 3}},
+		},
+		{
+			name: "group",
+			pipeline: bson.A{
+				bson.M{"$group": bson.M{
+					"_id": "$user", "sum": bson.M{"$sum": "$qty"}, "n": bson.M{"$sum": 1},
+					"max": bson.M{"$max": "$qty"}, "ids": bson.M{"$push": "$_id"},
+				}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			},
+			want: []bson.M{
+				{"_id": "u1", "sum": 3, "n": 2, "max": 2, "ids": bson.A{1, 3}},
+				{"_id": "u2", "sum": 5, "n": 1, "max": 5, "ids": bson.A{2}},
+			},
+		},
+		{
+			name: "lookup",
+			pipeline: bson.A{
+				bson.M{"$match": bson.M{"_id": 2}},
+				bson.M{"$lookup": bson.M{"from": "users", "localField": "user", "foreignField": "_id", "as": "u"}},
+				bson.M{"$project": bson.M{"u": 1}},
+			},
+			want: []bson.M{{"_id": 2, "u": bson.A{bson.M{"_id": "u2", "name": "bob"}}}},
+		},
+		{
+			name: "replaceRoot",
+			pipeline: bson.A{
+				bson.M{"$match": bson.M{"_id": 1}},
+				bson.M{"$lookup": bson.M{"from": "users", "localField": "user", "foreignField": "_id", "as": "u"}},
+				bson.M{"$unwind": "$u"},
+				bson.M{"$replaceRoot": bson.M{"newRoot": "$u"}},
+			},
+			want: []bson.M{{"_id": "u1", "name": "amy"}},
+		},
+		{
+			name: "facet",
+			pipeline: bson.A{
+				bson.M{"$sort": bson.M{"_id": 1}},
+				bson.M{"$facet": bson.M{
+					"total": bson.A{bson.M{"$count": "n"}},
+					"rows":  bson.A{bson.M{"$limit": 1}, bson.M{"$project": bson.M{"_id": 1}}},
+				}},
+			},
+			want: []bson.M{{"total": bson.A{bson.M{"n": 3}}, "rows": bson.A{bson.M{"_id": 1}}}},
+		},
+	}
+	for _, tt := range tests {
+		cur, err := db.Collection("orders").Aggregate(context.Background(), tt.pipeline)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := readAll(t, cur, nil); !sameDocs(t, got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemPipelineErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline bson.A
+	}{
+		{"unknown stage", bson.A{bson.M{"$bogus": 1}}},
+		{"two fields", bson.A{bson.D{{Key: "$match", Value: bson.M{}}, {Key: "$limit", Value: 1}}}},
+		{"unwind without $", bson.A{bson.M{"$unwind": "items"}}},
+		{"lookup missing as", bson.A{bson.M{"$lookup": bson.M{"from": "users", "localField": "user", "foreignField": "_id"}}}},
+	}
+	db := memSeed(t, map[string][]interface{}{"orders": {bson.M{"_id": 1, "items": bson.A{"a"}}}})
+	for _, tt := range tests {
+		if _, err := db.Collection("orders").Aggregate(context.Background(), tt.pipeline); err == nil {
+			t.Errorf("%s: want an error", tt.name)
+		}
+	}
+}
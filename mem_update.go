@@ -0,0 +1,330 @@
+package morm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// setPath stores val at parts below v, creating missing documents on the
+// way, and returns the updated container.
+func setPath(v interface{}, parts []string, val interface{}) (interface{}, error) {
+	if len(parts) == 0 {
+		return val, nil
+	}
+	switch t := v.(type) {
+	case primitive.D:
+		for i := range t {
+			if t[i].Key == parts[0] {
+				nv, err := setPath(t[i].Value, parts[1:], val)
+				if err != nil {
+					return t, err
+				}
+				t[i].Value = nv
+				return t, nil
+			}
+		}
+		nv, err := setPath(primitive.D{}, parts[1:], val)
+		if err != nil {
+			return t, err
+		}
+		return append(t, primitive.E{Key: parts[0], Value: nv}), nil
+	case primitive.A:
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || idx < 0 {
+			return t, fmt.Errorf("cannot create field '%s' in an array", parts[0])
+		}
+		for len(t) <= idx {
+			t = append(t, nil)
+		}
+		nv, err := setPath(t[idx], parts[1:], val)
+		if err != nil {
+			return t, err
+		}
+		t[idx] = nv
+		return t, nil
+	}
+	return v, fmt.Errorf("cannot create field '%s' in element %v", parts[0], v)
+}
+
+// unsetPath removes the value at parts, array entries are set to null.
+func unsetPath(v interface{}, parts []string) interface{} {
+	switch t := v.(type) {
+	case primitive.D:
+		for i := range t {
+			if t[i].Key != parts[0] {
+				continue
+			}
+			if len(parts) == 1 {
+				return append(t[:i:i], t[i+1:]...)
+			}
+			t[i].Value = unsetPath(t[i].Value, parts[1:])
+			return t
+		}
+	case primitive.A:
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || idx < 0 || idx >= len(t) {
+			return t
+		}
+		if len(parts) == 1 {
+			t[idx] = nil
+		} else {
+			t[idx] = unsetPath(t[idx], parts[1:])
+		}
+	}
+	return v
+}
+
+func setDocPath(doc bson.D, path string, val interface{}) (bson.D, error) {
+	nv, err := setPath(doc, strings.Split(path, "."), val)
+	if err != nil {
+		return doc, &memWriteErr{code: 28, msg: err.Error()}
+	}
+	return nv.(primitive.D), nil
+}
+
+func unsetDocPath(doc bson.D, path string) bson.D {
+	return unsetPath(doc, strings.Split(path, ".")).(primitive.D)
+}
+
+func addNumbers(a, b interface{}) (interface{}, error) {
+	if typeRank(a) != 2 || typeRank(b) != 2 {
+		return nil, fmt.Errorf("cannot apply $inc to a value of non-numeric type")
+	}
+	ai, aInt := toInt64(a)
+	bi, bInt := toInt64(b)
+	if !aInt || !bInt {
+		return toFloat(a) + toFloat(b), nil
+	}
+	sum := ai + bi
+	_, a64 := a.(int64)
+	_, b64 := b.(int64)
+	if !a64 && !b64 && sum >= math.MinInt32 && sum <= math.MaxInt32 {
+		return int32(sum), nil
+	}
+	return sum, nil
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case int32:
+		return int64(t), true
+	case int64:
+		return t, true
+	}
+	return 0, false
+}
+
+// updatePaths rejects updates that touch the same path twice, as mongo does.
+func updatePaths(update bson.D) error {
+	var paths []string
+	for _, op := range update {
+		fields, ok := op.Value.(primitive.D)
+		if !ok {
+			return fmt.Errorf("modifiers operate on fields but we found type %T instead", op.Value)
+		}
+		for _, f := range fields {
+			paths = append(paths, f.Key)
+			if op.Key == "$rename" {
+				if to, ok := f.Value.(string); ok {
+					paths = append(paths, to)
+				}
+			}
+		}
+	}
+	for i := range paths {
+		for j := range paths {
+			if i == j {
+				continue
+			}
+			if paths[i] == paths[j] || strings.HasPrefix(paths[j], paths[i]+".") {
+				return &memWriteErr{code: 40, msg: fmt.Sprintf(
+					"Updating the path '%s' would create a conflict at '%s'", paths[j], paths[i])}
+			}
+		}
+	}
+	return nil
+}
+
+func checkUpdateDoc(update bson.D) error {
+	if len(update) == 0 {
+		return fmt.Errorf("update document must have at least one element")
+	}
+	for _, op := range update {
+		if !strings.HasPrefix(op.Key, "$") {
+			return fmt.Errorf("update document requires atomic operators")
+		}
+	}
+	return updatePaths(update)
+}
+
+// applyUpdate runs the update operators on a copy of doc.
+func applyUpdate(doc bson.D, update bson.D, inserting bool) (bson.D, error) {
+	doc = copyDoc(doc)
+	var err error
+	for _, op := range update {
+		fields := op.Value.(primitive.D)
+		for _, f := range fields {
+			doc, err = applyOperator(doc, op.Key, f.Key, f.Value, inserting)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+func applyOperator(doc bson.D, op, path string, val interface{}, inserting bool) (bson.D, error) {
+	old, exists := lookupPath(doc, path)
+	switch op {
+	case "$set":
+		return setDocPath(doc, path, copyValue(val))
+	case "$setOnInsert":
+		if !inserting {
+			return doc, nil
+		}
+		return setDocPath(doc, path, copyValue(val))
+	case "$unset":
+		return unsetDocPath(doc, path), nil
+	case "$inc":
+		if !exists {
+			old = int32(0)
+		}
+		sum, err := addNumbers(old, val)
+		if err != nil {
+			return doc, &memWriteErr{code: 14, msg: err.Error()}
+		}
+		return setDocPath(doc, path, sum)
+	case "$min", "$max":
+		if exists {
+			c := compareValues(val, old)
+			if (op == "$min" && c >= 0) || (op == "$max" && c <= 0) {
+				return doc, nil
+			}
+		}
+		return setDocPath(doc, path, copyValue(val))
+	case "$currentDate":
+		var now interface{} = nowDateTime()
+		if spec, ok := val.(primitive.D); ok {
+			if t, _ := docGet(spec, "$type"); t == "timestamp" {
+				now = primitive.Timestamp{T: uint32(nowDateTime() / 1000)}
+			}
+		}
+		return setDocPath(doc, path, now)
+	case "$rename":
+		to, ok := val.(string)
+		if !ok {
+			return doc, fmt.Errorf("the 'to' field for $rename must be a string")
+		}
+		if !exists {
+			return doc, nil
+		}
+		doc = unsetDocPath(doc, path)
+		return setDocPath(doc, to, old)
+	case "$push", "$addToSet":
+		arr, ok := old.(primitive.A)
+		if exists && !ok {
+			return doc, &memWriteErr{code: 2, msg: fmt.Sprintf("The field '%s' must be an array", path)}
+		}
+		items := primitive.A{val}
+		if spec, ok := val.(primitive.D); ok && isOperatorDoc(spec) {
+			for _, m := range spec {
+				if m.Key != "$each" {
+					return doc, fmt.Errorf("unsupported %s modifier: %s", op, m.Key)
+				}
+				each, ok := m.Value.(primitive.A)
+				if !ok {
+					return doc, fmt.Errorf("the argument to $each must be an array")
+				}
+				items = each
+			}
+		}
+		arr = append(primitive.A{}, arr...)
+		for _, item := range items {
+			if op == "$addToSet" {
+				if m, _ := matchEq([]interface{}{arr}, item); m {
+					continue
+				}
+			}
+			arr = append(arr, copyValue(item))
+		}
+		return setDocPath(doc, path, arr)
+	case "$pull":
+		arr, ok := old.(primitive.A)
+		if !exists {
+			return doc, nil
+		}
+		if !ok {
+			return doc, &memWriteErr{code: 2, msg: "Cannot apply $pull to a non-array value"}
+		}
+		kept := primitive.A{}
+		for _, item := range arr {
+			var m bool
+			var err error
+			cond, isDoc := val.(primitive.D)
+			switch {
+			case isDoc && isOperatorDoc(cond):
+				m, err = matchOperators([]interface{}{item}, cond)
+			case isDoc:
+				if sub, ok := item.(primitive.D); ok {
+					m, err = matchFilter(sub, cond)
+				}
+			default:
+				m = valuesEqual(item, val)
+			}
+			if err != nil {
+				return doc, err
+			}
+			if !m {
+				kept = append(kept, item)
+			}
+		}
+		return setDocPath(doc, path, kept)
+	}
+	return doc, fmt.Errorf("unsupported update operator: %s", op)
+}
+
+// upsertSeed builds the document an upsert starts from out of the equality
+// conditions in its filter.
+func upsertSeed(filter bson.D) (bson.D, error) {
+	doc := bson.D{}
+	var err error
+	for _, e := range filter {
+		switch {
+		case e.Key == "$and":
+			subs, _ := e.Value.(primitive.A)
+			for _, s := range subs {
+				sd, ok := s.(primitive.D)
+				if !ok {
+					continue
+				}
+				seed, err := upsertSeed(sd)
+				if err != nil {
+					return nil, err
+				}
+				for _, se := range seed {
+					if doc, err = setDocPath(doc, se.Key, se.Value); err != nil {
+						return nil, err
+					}
+				}
+			}
+		case strings.HasPrefix(e.Key, "$"):
+		case isOperatorDoc(e.Value):
+			if eq, ok := docGet(e.Value.(primitive.D), "$eq"); ok {
+				doc, err = setDocPath(doc, e.Key, copyValue(eq))
+			}
+		default:
+			if _, isRegex := e.Value.(primitive.Regex); !isRegex {
+				doc, err = setDocPath(doc, e.Key, copyValue(e.Value))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
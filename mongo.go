@@ -3,8 +3,10 @@ package morm
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"reflect"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -29,6 +31,12 @@ type MgoDBModel interface {
 	Save(d DocInter, u LogUser) (interface{}, error)
 	RemoveAll(d DocInter, q primitive.M, u LogUser) (int64, error)
 	RemoveByID(d DocInter, u LogUser) (int64, error)
+	Restore(d DocInter, u LogUser) (int64, error)
+	Purge(d DocInter, q bson.M, u LogUser) (int64, error)
+	// WithDeleted returns a copy of the model whose reads include soft deleted docs
+	WithDeleted() MgoDBModel
+	// WithContext returns a copy of the model whose calls all run with ctx
+	WithContext(ctx context.Context) MgoDBModel
 	UpdateOne(d DocInter, fields bson.D, u LogUser) (int64, error)
 	UpdateAll(d DocInter, q bson.M, fields bson.D, u LogUser) (int64, error)
 	UnsetFields(d DocInter, q bson.M, fields []string, u LogUser) (int64, error)
@@ -48,27 +56,32 @@ type MgoDBModel interface {
 		exec func(i interface{}) error,
 		opts ...*options.AggregateOptions,
 	) error
-	PagePipeFind(aggr MgoAggregate, filter bson.M, sort bson.M, limit, page int64) (interface{}, error)
+	PagePipeFind(aggr MgoAggregate, filter bson.M, sort bson.M, limit, page int64, opts ...*options.AggregateOptions) (interface{}, error)
 	PageFind(d DocInter, q bson.M, limit, page int64, opts ...*options.FindOptions) (interface{}, error)
 
-	CountDocuments(d Collection, q bson.M) (int64, error)
+	CountDocuments(d Collection, q bson.M, opts ...*options.CountOptions) (int64, error)
 	GetPaginationSource(d DocInter, q bson.M, opts ...*options.FindOptions) format.PaginationSource
-	GetPipePaginationSource(aggr MgoAggregate, q bson.M, sort bson.M) format.PaginationSource
+	GetPipePaginationSource(aggr MgoAggregate, q bson.M, sort bson.M, opts ...*options.AggregateOptions) format.PaginationSource
+	GetHistoryPaginationSource(d DocInter) format.PaginationSource
+	GetCursorPaginationSource(d DocInter, q bson.M, sort bson.D) format.CursorPaginationSource
+	GetPipeCursorPaginationSource(aggr MgoAggregate, q bson.M, sort bson.D, opts ...*options.AggregateOptions) format.CursorPaginationSource
 
 	CreateCollection(dlist ...DocInter) error
 	//Reference to customer code, use for aggregate pagination
-	CountAggrDocuments(aggr MgoAggregate, q bson.M) (int64, error)
-	GetPipeMatchPaginationSource(aggr MgoAggregate, q bson.M, sort bson.M) format.PaginationSource
+	CountAggrDocuments(aggr MgoAggregate, q bson.M, opts ...*options.AggregateOptions) (int64, error)
+	GetPipeMatchPaginationSource(aggr MgoAggregate, q bson.M, sort bson.M, opts ...*options.AggregateOptions) format.PaginationSource
+	// GetPipeFacetPaginationSource counts and pages in one aggregation
+	GetPipeFacetPaginationSource(aggr MgoAggregate, q bson.M, sort bson.M, opts ...*options.AggregateOptions) format.PaginationSource
 
 	NewFindMgoDS(d DocInter, q bson.M, opts ...*options.FindOptions) MgoDS
 	NewPipeFindMgoDS(d MgoAggregate, q bson.M, opts ...*options.AggregateOptions) MgoDS
+	NewImporter(d DocInter, opts ImportOptions) Importer
 }
 
 func NewMgoModel(ctx context.Context, db *mongo.Database) MgoDBModel {
 	return &mgoModelImpl{
-		db:      db,
-		ctx:     ctx,
-		selfCtx: context.Background(),
+		db:  newDriverDatabase(db),
+		ctx: ctx,
 	}
 }
 
@@ -78,18 +91,16 @@ func NewMgoModelByReq(req *http.Request) MgoDBModel {
 		panic("database not set in req")
 	}
 	return &mgoModelImpl{
-		db:      mgodbclt.GetDbConn(),
-		ctx:     req.Context(),
-		selfCtx: context.Background(),
+		db:  newDriverDatabase(mgodbclt.GetDbConn()),
+		ctx: req.Context(),
 	}
 }
 
 type mgoModelImpl struct {
 	disableCheckBeforeSave bool
-	db                     *mongo.Database
+	withDeleted            bool
+	db                     mgoDatabase
 	ctx                    context.Context
-
-	selfCtx context.Context
 }
 
 func (mm *mgoModelImpl) DisableCheckBeforeSave(b bool) {
@@ -97,20 +108,41 @@ func (mm *mgoModelImpl) DisableCheckBeforeSave(b bool) {
 }
 
 func (mm *mgoModelImpl) SetDB(db *mongo.Database) {
-	mm.db = db
+	mm.db = newDriverDatabase(db)
+}
+
+func (mm *mgoModelImpl) WithContext(ctx context.Context) MgoDBModel {
+	if ctx == nil {
+		panic("nil context")
+	}
+	cp := *mm
+	cp.ctx = ctx
+	return &cp
 }
 
 func (mm *mgoModelImpl) FindAndExec(
 	d DocInter, q bson.M,
 	exec func(i interface{}) error,
 	opts ...*options.FindOptions,
+) error {
+	return mm.findAndExec(d, q, exec, true, opts...)
+}
+
+// findAndExec copies the last doc into d when copyBack is set, the
+// parallel exports leave d alone as it is shared by their runs.
+func (mm *mgoModelImpl) findAndExec(
+	d DocInter, q bson.M,
+	exec func(i interface{}) error,
+	copyBack bool,
+	opts ...*options.FindOptions,
 ) error {
 	var err error
 	collection := mm.db.Collection(d.GetC())
-	sortCursor, err := collection.Find(mm.ctx, q, opts...)
+	sortCursor, err := collection.Find(mm.ctx, mm.liveFilter(d, q), opts...)
 	if err != nil {
-		return nil
+		return err
 	}
+	defer sortCursor.Close(mm.ctx)
 	val := reflect.ValueOf(d)
 	if val.Kind() == reflect.Ptr {
 		val = reflect.Indirect(val)
@@ -124,13 +156,20 @@ func (mm *mgoModelImpl) FindAndExec(
 		if err != nil {
 			return err
 		}
+		err = callAfterFind(newDoc)
+		if err != nil {
+			return err
+		}
 		err = exec(newDoc)
 		if err != nil {
 			return err
 		}
 	}
+	if err = sortCursor.Err(); err != nil {
+		return err
+	}
 	w2 := reflect.ValueOf(newValue)
-	if w2.IsZero() {
+	if !copyBack || w2.IsZero() {
 		return nil
 	}
 	for i := 0; i < val.NumField(); i++ {
@@ -140,12 +179,12 @@ func (mm *mgoModelImpl) FindAndExec(
 	return err
 }
 
-func (mm *mgoModelImpl) CountDocuments(d Collection, q bson.M) (int64, error) {
-	return mm.db.Collection(d.GetC()).CountDocuments(mm.ctx, q)
+func (mm *mgoModelImpl) CountDocuments(d Collection, q bson.M, opts ...*options.CountOptions) (int64, error) {
+	return mm.db.Collection(d.GetC()).CountDocuments(mm.ctx, mm.liveFilter(d, q), opts...)
 }
 
 func (mm *mgoModelImpl) isCollectExisted(d DocInter) bool {
-	names, err := mm.db.ListCollectionNames(mm.selfCtx, bson.D{{Key: "name", Value: d.GetC()}})
+	names, err := mm.db.ListCollectionNames(mm.ctx, bson.D{{Key: "name", Value: d.GetC()}})
 	if ce, ok := err.(mongo.CommandError); ok {
 		return ce.Name == "OperationNotSupportedInTransaction"
 	}
@@ -157,7 +196,7 @@ func (mm *mgoModelImpl) CreateCollection(dlist ...DocInter) (err error) {
 		// check collection exist
 		if !mm.isCollectExisted(d) {
 			if len(d.GetIndexes()) > 0 {
-				_, err = mm.db.Collection(d.GetC()).Indexes().CreateMany(mm.ctx, d.GetIndexes())
+				err = mm.db.CreateIndexes(mm.ctx, d.GetC(), d.GetIndexes())
 			} else {
 				err = mm.db.CreateCollection(mm.ctx, d.GetC())
 			}
@@ -169,33 +208,160 @@ func (mm *mgoModelImpl) CreateCollection(dlist ...DocInter) (err error) {
 	return
 }
 
+// DocError is the reason one doc of a batch failed.
+type DocError struct {
+	Doc DocInter
+	Err error
+}
+
+// DocErrors pairs the failed docs returned by BatchSave or BatchUpdate with
+// their reason, given the doclist and err of the call: the error of their
+// Validator, which runs again, the write error of the server or err itself.
+func DocErrors(doclist, failed []DocInter, err error) []*DocError {
+	if len(failed) == 0 {
+		return nil
+	}
+	isFailed := make(map[DocInter]bool, len(failed))
+	for _, d := range failed {
+		isFailed[d] = true
+	}
+	writeErrs := map[int]error{}
+	var excep mongo.BulkWriteException
+	if errors.As(err, &excep) {
+		for _, we := range excep.WriteErrors {
+			writeErrs[we.Index] = we
+		}
+	}
+	docErrs := make([]*DocError, 0, len(failed))
+	sent := 0
+	for _, d := range doclist {
+		reason := validateDoc(d)
+		if reason == nil {
+			// the write errors are indexed among the docs sent
+			reason = writeErrs[sent]
+			sent++
+		}
+		if !isFailed[d] {
+			continue
+		}
+		if reason == nil {
+			reason = err
+		}
+		docErrs = append(docErrs, &DocError{Doc: d, Err: reason})
+	}
+	return docErrs
+}
+
+// BatchUpdate upserts the fields of the valid docs of doclist, docs
+// failing their Validator or the write are returned in failed, see
+// DocErrors for their reasons. With a user existing docs get an update
+// record and new ones a create record, or entries in their history.
 func (mm *mgoModelImpl) BatchUpdate(doclist []DocInter, getField func(d DocInter) bson.D, u LogUser) (failed []DocInter, err error) {
 	if len(doclist) == 0 {
 		return
 	}
 	collection := mm.db.Collection(doclist[0].GetC())
-	var operations []mongo.WriteModel
+	var sent []DocInter
 	for _, d := range doclist {
+		if err = callBeforeUpdate(d); err != nil {
+			return doclist, err
+		}
+		if validateDoc(d) != nil {
+			failed = append(failed, d)
+			continue
+		}
+		sent = append(sent, d)
+	}
+	if len(sent) == 0 {
+		return
+	}
+	history := u != nil && isHistoryDoc(sent[0])
+	exists := map[string]bool{}
+	if u != nil {
+		ids := make(bson.A, len(sent))
+		for i, d := range sent {
+			ids[i] = d.GetID()
+		}
+		q := bson.M{"_id": bson.M{"$in": ids}}
+		var found []interface{}
+		if found, err = mm.findIDs(sent[0], q); err != nil {
+			return doclist, err
+		}
+		for _, id := range found {
+			exists[fmt.Sprint(id)] = true
+		}
+		if !history {
+			if err = mm.initRecords(sent[0], q); err != nil {
+				return doclist, err
+			}
+		}
+	}
+	now := time.Now()
+	operations := make([]mongo.WriteModel, len(sent))
+	for i, d := range sent {
+		set := getField(d)
+		var push bson.D
+		if u != nil && !history {
+			// records are kept by the model, not taken from the fields
+			kept := make(bson.D, 0, len(set)+1)
+			for _, e := range set {
+				if e.Key != "records" {
+					kept = append(kept, e)
+				}
+			}
+			set = kept
+			if exists[fmt.Sprint(d.GetID())] {
+				push = bson.D{{Key: "$push", Value: bson.M{"records": NewRecord(now, u.GetAccount(), u.GetName(), "updated")}}}
+			} else {
+				set = append(set, primitive.E{Key: "records", Value: bson.A{NewRecord(now, u.GetAccount(), u.GetName(), "create")}})
+			}
+		}
 		op := mongo.NewUpdateOneModel()
-
 		op.SetFilter(bson.M{"_id": d.GetID()})
-		op.SetUpdate(bson.D{
-			{Key: "$set", Value: getField(d)},
-		})
+		op.SetUpdate(append(bson.D{{Key: "$set", Value: set}}, push...))
 		op.SetUpsert(true)
-		operations = append(operations, op)
+		operations[i] = op
 	}
-	bulkOption := options.BulkWriteOptions{}
-	_, err = collection.BulkWrite(mm.ctx, operations, &bulkOption)
+	ordered := false
+	_, err = collection.BulkWrite(mm.ctx, operations, &options.BulkWriteOptions{Ordered: &ordered})
 
+	failedIdx := map[int]bool{}
 	if excep, ok := err.(mongo.BulkWriteException); ok {
 		for _, e := range excep.WriteErrors {
-			failed = append(failed, doclist[e.Index])
+			failed = append(failed, sent[e.Index])
+			failedIdx[e.Index] = true
+		}
+	}
+	if err != nil && len(failedIdx) == 0 {
+		return
+	}
+	var created, updated []interface{}
+	for i, d := range sent {
+		if failedIdx[i] {
+			continue
+		}
+		if exists[fmt.Sprint(d.GetID())] {
+			updated = append(updated, d.GetID())
+		} else {
+			created = append(created, d.GetID())
+		}
+		if hookErr := callAfterUpdate(d); hookErr != nil {
+			return failed, hookErr
+		}
+	}
+	if history {
+		entries := append(newHistoryEntries(created, u, HistoryCreate, "create"),
+			newHistoryEntries(updated, u, HistoryUpdate, "updated")...)
+		if histErr := mm.writeHistory(sent[0], entries); histErr != nil {
+			return failed, histErr
 		}
 	}
 	return
 }
 
+// BatchSave inserts the valid docs of doclist, docs failing their
+// Validator or the insert are returned in failed, see DocErrors for their
+// reasons.
 func (mm *mgoModelImpl) BatchSave(doclist []DocInter, u LogUser) (inserted []interface{}, failed []DocInter, err error) {
 	if len(doclist) == 0 {
 		inserted = nil
@@ -210,11 +376,23 @@ func (mm *mgoModelImpl) BatchSave(doclist []DocInter, u LogUser) (inserted []int
 	}
 	ordered := false
 	var batch []interface{}
+	var sent []DocInter
 	for _, d := range doclist {
-		if u != nil {
+		if err = callBeforeSave(d); err != nil {
+			return nil, doclist, err
+		}
+		if validateDoc(d) != nil {
+			failed = append(failed, d)
+			continue
+		}
+		if u != nil && !isHistoryDoc(d) {
 			d.SetCreator(u)
 		}
 		batch = append(batch, d)
+		sent = append(sent, d)
+	}
+	if len(batch) == 0 {
+		return
 	}
 	var result *mongo.InsertManyResult
 	result, err = collection.InsertMany(mm.ctx, batch, &options.InsertManyOptions{Ordered: &ordered})
@@ -222,9 +400,29 @@ func (mm *mgoModelImpl) BatchSave(doclist []DocInter, u LogUser) (inserted []int
 		inserted = result.InsertedIDs
 	}
 
+	failedIdx := map[int]bool{}
 	if excep, ok := err.(mongo.BulkWriteException); ok {
 		for _, e := range excep.WriteErrors {
-			failed = append(failed, doclist[e.Index])
+			failed = append(failed, sent[e.Index])
+			failedIdx[e.Index] = true
+		}
+	}
+	if err != nil && len(failedIdx) == 0 {
+		return
+	}
+	var ids []interface{}
+	for i, d := range sent {
+		if failedIdx[i] {
+			continue
+		}
+		ids = append(ids, d.GetID())
+		if hookErr := callAfterSave(d); hookErr != nil {
+			return inserted, failed, hookErr
+		}
+	}
+	if u != nil && isHistoryDoc(sent[0]) {
+		if histErr := mm.writeHistory(sent[0], newHistoryEntries(ids, u, HistoryCreate, "create")); histErr != nil {
+			return inserted, failed, histErr
 		}
 	}
 	return
@@ -238,7 +436,13 @@ func (mm *mgoModelImpl) Save(d DocInter, u LogUser) (interface{}, error) {
 		}
 	}
 
-	if u != nil {
+	if err := callBeforeSave(d); err != nil {
+		return primitive.NilObjectID, err
+	}
+	if err := validateDoc(d); err != nil {
+		return primitive.NilObjectID, err
+	}
+	if u != nil && !isHistoryDoc(d) {
 		d.SetCreator(u)
 	}
 	collection := mm.db.Collection(d.GetC())
@@ -247,25 +451,66 @@ func (mm *mgoModelImpl) Save(d DocInter, u LogUser) (interface{}, error) {
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
-	return result.InsertedID, err
-
+	if u != nil && isHistoryDoc(d) {
+		err = mm.writeHistory(d, newHistoryEntries([]interface{}{result.InsertedID}, u, HistoryCreate, "create"))
+		if err != nil {
+			return result.InsertedID, err
+		}
+	}
+	return result.InsertedID, callAfterSave(d)
 }
 
 func (mm *mgoModelImpl) RemoveAll(d DocInter, q primitive.M, u LogUser) (int64, error) {
-	collection := mm.db.Collection(d.GetC())
-	result, err := collection.DeleteMany(mm.ctx, q)
-	return result.DeletedCount, err
+	if _, ok := d.(SoftDeleteDoc); ok {
+		return mm.softRemove(d, q, u, true)
+	}
+	return mm.hardRemove(d, q, u, true)
 }
 
 func (mm *mgoModelImpl) RemoveByID(d DocInter, u LogUser) (int64, error) {
-	collection := mm.db.Collection(d.GetC())
-	result, err := collection.DeleteOne(mm.ctx, bson.M{"_id": d.GetID()})
-	return result.DeletedCount, err
+	if err := callBeforeDelete(d); err != nil {
+		return 0, err
+	}
+	n, err := mm.removeByID(d, u)
+	if err != nil {
+		return n, err
+	}
+	return n, callAfterDelete(d)
+}
+
+func (mm *mgoModelImpl) removeByID(d DocInter, u LogUser) (int64, error) {
+	if _, ok := d.(SoftDeleteDoc); ok {
+		return mm.softRemove(d, bson.M{"_id": d.GetID()}, u, false)
+	}
+	return mm.hardRemove(d, bson.M{"_id": d.GetID()}, u, false)
 }
 
 func (mm *mgoModelImpl) UpdateOne(d DocInter, fields bson.D, u LogUser) (int64, error) {
+	if err := callBeforeUpdate(d); err != nil {
+		return 0, err
+	}
+	n, err := mm.updateOne(d, fields, u)
+	if err != nil {
+		return n, err
+	}
+	return n, callAfterUpdate(d)
+}
+
+func (mm *mgoModelImpl) updateOne(d DocInter, fields bson.D, u LogUser) (int64, error) {
+	if vd, ok := d.(VersionDoc); ok {
+		return mm.versionedUpdateOne(d, vd, fields, u)
+	}
+	var changes []*FieldChange
 	if u != nil {
-		fields = append(fields, primitive.E{Key: "records", Value: d.AddRecord(u, "updated")})
+		var err error
+		if changes, err = mm.changesOf(d, fields); err != nil {
+			return 0, err
+		}
+	}
+	if u != nil && !isHistoryDoc(d) {
+		records := d.AddRecord(u, "updated")
+		attachChanges(records, changes)
+		fields = append(fields, primitive.E{Key: "records", Value: records})
 	}
 	collection := mm.db.Collection(d.GetC())
 	result, err := collection.UpdateOne(mm.ctx, bson.M{"_id": d.GetID()},
@@ -273,42 +518,78 @@ func (mm *mgoModelImpl) UpdateOne(d DocInter, fields bson.D, u LogUser) (int64,
 			{Key: "$set", Value: fields},
 		},
 	)
-	if result != nil {
-		return result.ModifiedCount, err
+	if result == nil {
+		return 0, err
 	}
-	return 0, err
+	if err == nil && u != nil && isHistoryDoc(d) && result.MatchedCount > 0 {
+		entries := newHistoryEntries([]interface{}{d.GetID()}, u, HistoryUpdate, "updated")
+		entries[0].Changes = changes
+		err = mm.writeHistory(d, entries)
+	}
+	return result.ModifiedCount, err
 }
 
 func (mm *mgoModelImpl) UpdateAll(d DocInter, q bson.M, fields bson.D, u LogUser) (int64, error) {
 	updated := bson.D{
 		{Key: "$set", Value: fields},
 	}
-	if u != nil {
-		updated = append(updated, primitive.E{Key: "$push", Value: primitive.M{"records": NewRecord(time.Now(), u.GetAccount(), u.GetName(), "updated")}})
-	}
-	collection := mm.db.Collection(d.GetC())
-	result, err := collection.UpdateMany(mm.ctx, q, updated)
-	if result != nil {
-		return result.ModifiedCount, err
+	if dd, ok := d.(DiffDoc); ok && u != nil {
+		return mm.updateEach(d, q, updated, u, HistoryUpdate, "updated", func(stored bson.D) ([]*FieldChange, error) {
+			return diffFields(stored, fields, dd.RedactFields())
+		})
 	}
-	return 0, err
+	return mm.updateMany(d, q, updated, u, "updated")
 }
 
 func (mm *mgoModelImpl) UnsetFields(d DocInter, q bson.M, fields []string, u LogUser) (int64, error) {
-	collection := mm.db.Collection(d.GetC())
 	m := primitive.M{}
 	for _, k := range fields {
 		m[k] = ""
 	}
-	result, err := collection.UpdateMany(mm.ctx, q,
-		bson.D{
-			{Key: "$unset", Value: m},
-		},
-	)
-	if result != nil {
-		return result.ModifiedCount, err
+	unset := bson.D{{Key: "$unset", Value: m}}
+	summary := "unset: " + strings.Join(fields, ", ")
+	if dd, ok := d.(DiffDoc); ok && u != nil {
+		return mm.updateEach(d, q, unset, u, HistoryUpdate, summary, func(stored bson.D) ([]*FieldChange, error) {
+			return diffUnset(stored, fields, dd.RedactFields()), nil
+		})
 	}
-	return 0, err
+	return mm.updateMany(d, q, unset, u, summary)
+}
+
+// updateMany runs update on every doc matching q and, with a user, records
+// summary on them or in their history.
+func (mm *mgoModelImpl) updateMany(d DocInter, q bson.M, update bson.D, u LogUser, summary string) (int64, error) {
+	history := u != nil && isHistoryDoc(d)
+	if u != nil && !history {
+		if err := mm.initRecords(d, q); err != nil {
+			return 0, err
+		}
+		update = append(update, primitive.E{Key: "$push", Value: primitive.M{"records": NewRecord(time.Now(), u.GetAccount(), u.GetName(), summary)}})
+	}
+	var ids []interface{}
+	if history {
+		var err error
+		if ids, err = mm.findIDs(d, q); err != nil {
+			return 0, err
+		}
+	}
+	collection := mm.db.Collection(d.GetC())
+	result, err := collection.UpdateMany(mm.ctx, q, update)
+	if result == nil {
+		return 0, err
+	}
+	if err == nil && history {
+		err = mm.writeHistory(d, newHistoryEntries(ids, u, HistoryUpdate, summary))
+	}
+	return result.ModifiedCount, err
+}
+
+// initRecords turns the null records of the docs matching q into an empty
+// array, $push fails on null.
+func (mm *mgoModelImpl) initRecords(d DocInter, q bson.M) error {
+	filter := bson.M{"$and": bson.A{q, bson.M{"records": nil}}}
+	_, err := mm.db.Collection(d.GetC()).UpdateMany(mm.ctx, filter, bson.D{{Key: "$set", Value: bson.M{"records": bson.A{}}}})
+	return err
 }
 
 func (mm *mgoModelImpl) Upsert(d DocInter, u LogUser) (interface{}, error) {
@@ -316,6 +597,19 @@ func (mm *mgoModelImpl) Upsert(d DocInter, u LogUser) (interface{}, error) {
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
+	if err = callBeforeSave(d); err != nil {
+		return primitive.NilObjectID, err
+	}
+	if err = validateDoc(d); err != nil {
+		return primitive.NilObjectID, err
+	}
+	if vd, ok := d.(VersionDoc); ok {
+		id, err := mm.versionedUpsert(d, vd)
+		if err != nil {
+			return id, err
+		}
+		return id, callAfterSave(d)
+	}
 
 	collection := mm.db.Collection(d.GetC())
 	_, err = collection.UpdateOne(mm.ctx, bson.M{"_id": d.GetID()}, bson.M{"$set": d.GetDoc()}, options.Update().SetUpsert(true))
@@ -323,7 +617,7 @@ func (mm *mgoModelImpl) Upsert(d DocInter, u LogUser) (interface{}, error) {
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
-	return d.GetID(), nil
+	return d.GetID(), callAfterSave(d)
 }
 
 func (mm *mgoModelImpl) FindByID(d DocInter) error {
@@ -338,14 +632,18 @@ func (mm *mgoModelImpl) FindOne(d DocInter, q bson.M, option ...*options.FindOne
 		return errors.New("doc is nil")
 	}
 	collection := mm.db.Collection(d.GetC())
-	return collection.FindOne(mm.ctx, q, option...).Decode(d)
+	err := collection.FindOne(mm.ctx, mm.liveFilter(d, q), option...).Decode(d)
+	if err != nil {
+		return err
+	}
+	return callAfterFind(d)
 }
 
 func (mm *mgoModelImpl) Find(d DocInter, q bson.M, option ...*options.FindOptions) (interface{}, error) {
 	myType := reflect.TypeOf(d)
 	slice := reflect.MakeSlice(reflect.SliceOf(myType), 0, 0).Interface()
 	collection := mm.db.Collection(d.GetC())
-	sortCursor, err := collection.Find(mm.ctx, q, option...)
+	sortCursor, err := collection.Find(mm.ctx, mm.liveFilter(d, q), option...)
 	if err != nil {
 		return nil, err
 	}
@@ -353,14 +651,14 @@ func (mm *mgoModelImpl) Find(d DocInter, q bson.M, option ...*options.FindOption
 	if err != nil {
 		return nil, err
 	}
-	return slice, err
+	return slice, callAfterFindAll(slice)
 }
 
 func (mm *mgoModelImpl) PipeFind(aggr MgoAggregate, filter bson.M, opts ...*options.AggregateOptions) (interface{}, error) {
 	myType := reflect.TypeOf(aggr)
 	slice := reflect.MakeSlice(reflect.SliceOf(myType), 0, 0).Interface()
 	collection := mm.db.Collection(aggr.GetC())
-	sortCursor, err := collection.Aggregate(mm.ctx, aggr.GetPipeline(filter), opts...)
+	sortCursor, err := collection.Aggregate(mm.ctx, aggr.GetPipeline(mm.liveFilter(aggr, filter)), opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -372,20 +670,25 @@ func (mm *mgoModelImpl) PipeFind(aggr MgoAggregate, filter bson.M, opts ...*opti
 }
 
 func (mm *mgoModelImpl) PipeFindAndExec(aggr MgoAggregate, filter bson.M, exec func(i interface{}) error, opts ...*options.AggregateOptions) error {
+	return mm.pipeFindAndExec(aggr, filter, exec, true, opts...)
+}
+
+func (mm *mgoModelImpl) pipeFindAndExec(aggr MgoAggregate, filter bson.M, exec func(i interface{}) error, copyBack bool, opts ...*options.AggregateOptions) error {
 	collection := mm.db.Collection(aggr.GetC())
-	sortCursor, err := collection.Aggregate(mm.ctx, aggr.GetPipeline(filter), opts...)
+	sortCursor, err := collection.Aggregate(mm.ctx, aggr.GetPipeline(mm.liveFilter(aggr, filter)), opts...)
 	if err != nil {
 		return err
 	}
+	defer sortCursor.Close(mm.ctx)
 	val := reflect.ValueOf(aggr)
 	if val.Kind() == reflect.Ptr {
 		val = reflect.Indirect(val)
 	}
 	var newValue reflect.Value
-	var newDoc DocInter
+	var newDoc interface{}
 	for sortCursor.Next(mm.ctx) {
 		newValue = reflect.New(val.Type())
-		newDoc = newValue.Interface().(DocInter)
+		newDoc = newValue.Interface()
 		err = sortCursor.Decode(newDoc)
 		if err != nil {
 			return err
@@ -395,9 +698,12 @@ func (mm *mgoModelImpl) PipeFindAndExec(aggr MgoAggregate, filter bson.M, exec f
 			return err
 		}
 	}
+	if err = sortCursor.Err(); err != nil {
+		return err
+	}
 
 	w2 := reflect.ValueOf(newValue)
-	if w2.IsZero() {
+	if !copyBack || w2.IsZero() {
 		return nil
 	}
 	for i := 0; i < val.NumField(); i++ {
@@ -409,7 +715,7 @@ func (mm *mgoModelImpl) PipeFindAndExec(aggr MgoAggregate, filter bson.M, exec f
 
 func (mm *mgoModelImpl) PipeFindOne(aggr MgoAggregate, filter bson.M) error {
 	collection := mm.db.Collection(aggr.GetC())
-	sortCursor, err := collection.Aggregate(mm.ctx, aggr.GetPipeline(filter))
+	sortCursor, err := collection.Aggregate(mm.ctx, aggr.GetPipeline(mm.liveFilter(aggr, filter)))
 	if err != nil {
 		return err
 	}
@@ -435,16 +741,19 @@ func (mm *mgoModelImpl) PageFind(d DocInter, filter bson.M, limit, page int64, o
 	myType := reflect.TypeOf(d)
 	slice := reflect.MakeSlice(reflect.SliceOf(myType), 0, 0).Interface()
 	collection := mm.db.Collection(d.GetC())
-	sortCursor, err := collection.Find(mm.ctx, filter, opts...)
+	sortCursor, err := collection.Find(mm.ctx, mm.liveFilter(d, filter), opts...)
 	if err != nil {
 		return nil, err
 	}
 
 	err = sortCursor.All(mm.ctx, &slice)
-	return slice, err
+	if err != nil {
+		return nil, err
+	}
+	return slice, callAfterFindAll(slice)
 }
 
-func (mm *mgoModelImpl) PagePipeFind(aggr MgoAggregate, filter bson.M, sort bson.M, limit, page int64) (interface{}, error) {
+func (mm *mgoModelImpl) PagePipeFind(aggr MgoAggregate, filter bson.M, sort bson.M, limit, page int64, opts ...*options.AggregateOptions) (interface{}, error) {
 	if limit <= 0 {
 		limit = 50
 	}
@@ -456,8 +765,8 @@ func (mm *mgoModelImpl) PagePipeFind(aggr MgoAggregate, filter bson.M, sort bson
 	slice := reflect.MakeSlice(reflect.SliceOf(myType), 0, 0).Interface()
 
 	collection := mm.db.Collection(aggr.GetC())
-	pl := append(aggr.GetPipeline(filter), bson.D{{Key: "$sort", Value: sort}}, bson.D{{Key: "$skip", Value: skip}}, bson.D{{Key: "$limit", Value: limit}})
-	sortCursor, err := collection.Aggregate(mm.ctx, pl)
+	pl := append(aggr.GetPipeline(mm.liveFilter(aggr, filter)), bson.D{{Key: "$sort", Value: sort}}, bson.D{{Key: "$skip", Value: skip}}, bson.D{{Key: "$limit", Value: limit}})
+	sortCursor, err := collection.Aggregate(mm.ctx, pl, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -471,17 +780,17 @@ func (mm *mgoModelImpl) PagePipeFind(aggr MgoAggregate, filter bson.M, sort bson
 // ----- New added code -----
 
 func (mm *mgoModelImpl) AggrCountDocuments(aggr MgoAggregate, q bson.M) (int64, error) {
-	return mm.db.Collection(aggr.GetC()).CountDocuments(mm.ctx, q)
+	return mm.db.Collection(aggr.GetC()).CountDocuments(mm.ctx, mm.liveFilter(aggr, q))
 }
 
 type countMgoAggregate struct {
 	Count int
 }
 
-func (mm *mgoModelImpl) CountAggrDocuments(aggr MgoAggregate, q bson.M) (int64, error) {
+func (mm *mgoModelImpl) CountAggrDocuments(aggr MgoAggregate, q bson.M, opts ...*options.AggregateOptions) (int64, error) {
 	collection := mm.db.Collection(aggr.GetC())
-	pl := append(aggr.GetPipeline(q), bson.D{{Key: "$count", Value: "count"}})
-	sortCursor, err := collection.Aggregate(mm.ctx, pl)
+	pl := append(aggr.GetPipeline(mm.liveFilter(aggr, q)), bson.D{{Key: "$count", Value: "count"}})
+	sortCursor, err := collection.Aggregate(mm.ctx, pl, opts...)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,107 @@
+package morm
+
+import (
+	"reflect"
+
+	"github.com/wayne011872/morm/format"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GetPipeFacetPaginationSource runs the pipeline of aggr once per page,
+// counting and slicing its output in a single $facet stage. The $facet
+// output is one document, a page larger than 16MB fails.
+func (mm *mgoModelImpl) GetPipeFacetPaginationSource(aggr MgoAggregate, q bson.M, sort bson.M, opts ...*options.AggregateOptions) format.PaginationSource {
+	return &mongoPipeFacetPaginationImpl{
+		MgoDBModel: mm,
+		a:          aggr,
+		q:          q,
+		sort:       sort,
+		opts:       opts,
+	}
+}
+
+type mongoPipeFacetPaginationImpl struct {
+	MgoDBModel
+	a    MgoAggregate
+	q    bson.M
+	sort bson.M
+	opts []*options.AggregateOptions
+}
+
+// facetAggregate ends the pipeline of a with the $facet stage, its docs
+// decode the single output of the stage.
+type facetAggregate struct {
+	Total []struct {
+		Count int64 `bson:"count"`
+	} `bson:"total"`
+	Rows []bson.Raw `bson:"rows"`
+
+	a    MgoAggregate
+	page bson.A
+}
+
+func (fa *facetAggregate) GetC() string {
+	return fa.a.GetC()
+}
+
+func (fa *facetAggregate) GetPipeline(q bson.M) mongo.Pipeline {
+	return append(fa.a.GetPipeline(q), bson.D{{Key: "$facet", Value: bson.D{
+		{Key: "total", Value: bson.A{bson.D{{Key: "$count", Value: "count"}}}},
+		{Key: "rows", Value: fa.page},
+	}}})
+}
+
+func (fa *facetAggregate) unwrap() interface{} {
+	return fa.a
+}
+
+func (mpi *mongoPipeFacetPaginationImpl) Count() (int64, error) {
+	return mpi.CountAggrDocuments(mpi.a, mpi.q, mpi.opts...)
+}
+
+func (mpi *mongoPipeFacetPaginationImpl) Data(limit, p int64, f format.ObjToMapFunc) ([]map[string]interface{}, error) {
+	_, rows, err := mpi.CountData(limit, p, f)
+	return rows, err
+}
+
+func (mpi *mongoPipeFacetPaginationImpl) CountData(limit, p int64, f format.ObjToMapFunc) (int64, []map[string]interface{}, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	if p <= 0 {
+		p = 1
+	}
+	var page bson.A
+	if len(mpi.sort) > 0 {
+		page = append(page, bson.D{{Key: "$sort", Value: mpi.sort}})
+	}
+	page = append(page, bson.D{{Key: "$skip", Value: limit * (p - 1)}}, bson.D{{Key: "$limit", Value: limit}})
+	result, err := mpi.PipeFind(&facetAggregate{a: mpi.a, page: page}, mpi.q, mpi.opts...)
+	if err != nil {
+		return 0, nil, err
+	}
+	facets := result.([]*facetAggregate)
+	if len(facets) == 0 {
+		return 0, nil, nil
+	}
+	var total int64
+	if len(facets[0].Total) > 0 {
+		total = facets[0].Total[0].Count
+	}
+	myType := reflect.TypeOf(mpi.a)
+	slice := reflect.MakeSlice(reflect.SliceOf(myType), 0, len(facets[0].Rows))
+	for _, raw := range facets[0].Rows {
+		doc := reflect.New(myType.Elem())
+		if err = bson.Unmarshal(raw, doc.Interface()); err != nil {
+			return 0, nil, err
+		}
+		slice = reflect.Append(slice, doc)
+	}
+	formatResult, l := format.DocToMap(slice.Interface(), f)
+	if l == 0 {
+		return total, nil, nil
+	}
+	return total, formatResult.([]map[string]interface{}), nil
+}
@@ -3,14 +3,16 @@ package morm
 import (
 	"github.com/wayne011872/morm/format"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func (mm *mgoModelImpl) GetPipeMatchPaginationSource(aggr MgoAggregate, q bson.M, sort bson.M) format.PaginationSource {
+func (mm *mgoModelImpl) GetPipeMatchPaginationSource(aggr MgoAggregate, q bson.M, sort bson.M, opts ...*options.AggregateOptions) format.PaginationSource {
 	return &mongoPipeMatchPaginationImpl{
 		MgoDBModel: mm,
 		a:          aggr,
 		q:          q,
 		sort:       sort,
+		opts:       opts,
 	}
 }
 
@@ -19,14 +21,15 @@ type mongoPipeMatchPaginationImpl struct {
 	a    MgoAggregate
 	q    bson.M
 	sort bson.M
+	opts []*options.AggregateOptions
 }
 
 func (mpi *mongoPipeMatchPaginationImpl) Count() (int64, error) {
-	return mpi.CountAggrDocuments(mpi.a, mpi.q)
+	return mpi.CountAggrDocuments(mpi.a, mpi.q, mpi.opts...)
 }
 
 func (mpi *mongoPipeMatchPaginationImpl) Data(limit, p int64, f format.ObjToMapFunc) ([]map[string]interface{}, error) {
-	result, err := mpi.PagePipeFind(mpi.a, mpi.q, mpi.sort, limit, p)
+	result, err := mpi.PagePipeFind(mpi.a, mpi.q, mpi.sort, limit, p, mpi.opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -3,14 +3,16 @@ package morm
 import (
 	"github.com/wayne011872/morm/format"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func (mm *mgoModelImpl) GetPipePaginationSource(aggr MgoAggregate, q bson.M, sort bson.M) format.PaginationSource {
+func (mm *mgoModelImpl) GetPipePaginationSource(aggr MgoAggregate, q bson.M, sort bson.M, opts ...*options.AggregateOptions) format.PaginationSource {
 	return &mongoPipePaginationImpl{
 		MgoDBModel: mm,
 		a:          aggr,
 		q:          q,
 		sort:       sort,
+		opts:       opts,
 	}
 }
 
@@ -19,14 +21,41 @@ type mongoPipePaginationImpl struct {
 	a    MgoAggregate
 	q    bson.M
 	sort bson.M
+	opts []*options.AggregateOptions
 }
 
 func (mpi *mongoPipePaginationImpl) Count() (int64, error) {
-	return mpi.CountDocuments(mpi.a, mpi.q)
+	return mpi.CountDocuments(mpi.a, mpi.q, countOptions(mpi.opts))
+}
+
+// countOptions carries the aggregate options that also apply to a count:
+// collation, hint, maxTime and comment. AllowDiskUse, BatchSize,
+// BypassDocumentValidation, MaxAwaitTime, Let and Custom only affect the
+// pipeline and are dropped.
+func countOptions(opts []*options.AggregateOptions) *options.CountOptions {
+	co := options.Count()
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.Collation != nil {
+			co.SetCollation(o.Collation)
+		}
+		if o.Hint != nil {
+			co.SetHint(o.Hint)
+		}
+		if o.MaxTime != nil {
+			co.SetMaxTime(*o.MaxTime)
+		}
+		if o.Comment != nil {
+			co.SetComment(*o.Comment)
+		}
+	}
+	return co
 }
 
 func (mpi *mongoPipePaginationImpl) Data(limit, p int64, f format.ObjToMapFunc) ([]map[string]interface{}, error) {
-	result, err := mpi.PagePipeFind(mpi.a, mpi.q, mpi.sort, limit, p)
+	result, err := mpi.PagePipeFind(mpi.a, mpi.q, mpi.sort, limit, p, mpi.opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,140 @@
+// Package query builds mongo filters. Every builder returns a bson.M so the
+// result can be passed wherever a filter is accepted.
+package query
+
+import (
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func Eq(field string, v interface{}) bson.M {
+	return bson.M{field: bson.M{"$eq": v}}
+}
+
+func Ne(field string, v interface{}) bson.M {
+	return bson.M{field: bson.M{"$ne": v}}
+}
+
+func Gt(field string, v interface{}) bson.M {
+	return bson.M{field: bson.M{"$gt": v}}
+}
+
+func Gte(field string, v interface{}) bson.M {
+	return bson.M{field: bson.M{"$gte": v}}
+}
+
+func Lt(field string, v interface{}) bson.M {
+	return bson.M{field: bson.M{"$lt": v}}
+}
+
+func Lte(field string, v interface{}) bson.M {
+	return bson.M{field: bson.M{"$lte": v}}
+}
+
+func In(field string, values ...interface{}) bson.M {
+	return bson.M{field: bson.M{"$in": bson.A(values)}}
+}
+
+func Nin(field string, values ...interface{}) bson.M {
+	return bson.M{field: bson.M{"$nin": bson.A(values)}}
+}
+
+// Between matches from <= field <= to.
+func Between(field string, from, to interface{}) bson.M {
+	return bson.M{field: bson.M{"$gte": from, "$lte": to}}
+}
+
+func Regex(field, pattern, options string) bson.M {
+	return bson.M{field: primitive.Regex{Pattern: pattern, Options: options}}
+}
+
+func Exists(field string, exists bool) bson.M {
+	return bson.M{field: bson.M{"$exists": exists}}
+}
+
+// ElemMatch matches docs whose array field has an element matching q.
+func ElemMatch(field string, q bson.M) bson.M {
+	return bson.M{field: bson.M{"$elemMatch": q}}
+}
+
+// And returns the single filter unchanged and joins more with $and. With no
+// filter it matches every doc.
+func And(qs ...bson.M) bson.M {
+	switch len(qs) {
+	case 0:
+		return bson.M{}
+	case 1:
+		return qs[0]
+	}
+	return bson.M{"$and": toA(qs)}
+}
+
+// Or returns the single filter unchanged and joins more with $or. With no
+// filter it matches no doc, the server rejects an empty $or.
+func Or(qs ...bson.M) bson.M {
+	switch len(qs) {
+	case 0:
+		return bson.M{"_id": bson.M{"$in": bson.A{}}}
+	case 1:
+		return qs[0]
+	}
+	return bson.M{"$or": toA(qs)}
+}
+
+// Not matches the docs q does not match.
+func Not(q bson.M) bson.M {
+	return bson.M{"$nor": bson.A{q}}
+}
+
+func toA(qs []bson.M) bson.A {
+	a := make(bson.A, len(qs))
+	for i, q := range qs {
+		a[i] = q
+	}
+	return a
+}
+
+// D converts q to a bson.D with keys in a stable order, recursing into
+// nested filters.
+func D(q bson.M) bson.D {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	d := make(bson.D, len(keys))
+	for i, k := range keys {
+		d[i] = bson.E{Key: k, Value: toD(q[k])}
+	}
+	return d
+}
+
+func toD(v interface{}) interface{} {
+	switch t := v.(type) {
+	case bson.M:
+		return D(t)
+	case map[string]interface{}:
+		return D(t)
+	case bson.A:
+		return toDList(t)
+	case []interface{}:
+		return toDList(t)
+	case []bson.M:
+		a := make(bson.A, len(t))
+		for i, e := range t {
+			a[i] = D(e)
+		}
+		return a
+	}
+	return v
+}
+
+func toDList(l []interface{}) bson.A {
+	a := make(bson.A, len(l))
+	for i, e := range l {
+		a[i] = toD(e)
+	}
+	return a
+}
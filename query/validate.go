@@ -0,0 +1,239 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var logicalOps = map[string]bool{
+	"$and": true, "$or": true, "$nor": true,
+}
+
+// topOps are top level operators whose arguments are not checked.
+var topOps = map[string]bool{
+	"$comment": true, "$expr": true, "$text": true, "$where": true, "$jsonSchema": true,
+}
+
+var fieldOps = map[string]bool{
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true,
+	"$in": true, "$nin": true, "$exists": true, "$type": true, "$regex": true,
+	"$options": true, "$not": true, "$size": true, "$all": true, "$elemMatch": true,
+	"$mod": true,
+}
+
+var (
+	bsonMarshaler      = reflect.TypeOf((*bson.Marshaler)(nil)).Elem()
+	bsonValueMarshaler = reflect.TypeOf((*bson.ValueMarshaler)(nil)).Elem()
+)
+
+// Validate checks that every field q filters on exists in the bson layout
+// of doc and that every operator is known. doc is a struct, a pointer to
+// one or a morm.DocInter.
+func Validate(q bson.M, doc interface{}) error {
+	if gd, ok := doc.(interface{ GetDoc() interface{} }); ok {
+		doc = gd.GetDoc()
+	}
+	return validateFilter(q, reflect.TypeOf(doc), "")
+}
+
+func validateFilter(q interface{}, t reflect.Type, prefix string) error {
+	entries, ok := toEntries(q)
+	if !ok {
+		return fmt.Errorf("filter %s must be a document", prefix)
+	}
+	for _, e := range entries {
+		if logicalOps[e.Key] {
+			subs, ok := toList(e.Value)
+			if !ok {
+				return fmt.Errorf("%s must be an array", e.Key)
+			}
+			for _, s := range subs {
+				if err := validateFilter(s, t, prefix); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if topOps[e.Key] {
+			continue
+		}
+		if strings.HasPrefix(e.Key, "$") {
+			return fmt.Errorf("unknown operator: %s", e.Key)
+		}
+		ft, ok := fieldType(t, strings.Split(e.Key, "."))
+		if !ok {
+			return fmt.Errorf("unknown field: %s", prefix+e.Key)
+		}
+		if err := validateCond(e.Value, ft, prefix+e.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateCond(v interface{}, t reflect.Type, field string) error {
+	ops, ok := toEntries(v)
+	if !ok || len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+		return nil
+	}
+	for _, op := range ops {
+		if !fieldOps[op.Key] {
+			return fmt.Errorf("unknown operator %s on %s", op.Key, field)
+		}
+		switch op.Key {
+		case "$not":
+			if err := validateCond(op.Value, t, field); err != nil {
+				return err
+			}
+		case "$elemMatch":
+			et := elemType(t)
+			sub, _ := toEntries(op.Value)
+			if len(sub) > 0 && strings.HasPrefix(sub[0].Key, "$") {
+				if err := validateCond(op.Value, et, field); err != nil {
+					return err
+				}
+			} else if err := validateFilter(op.Value, et, field+"."); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fieldType resolves a dotted path the way mongo does, stepping into array
+// elements and accepting numeric indexes. A nil type accepts any path.
+func fieldType(t reflect.Type, parts []string) (reflect.Type, bool) {
+	for _, p := range parts {
+		t = deref(t)
+		if t == nil || isOpaque(t) {
+			return nil, true
+		}
+		switch t.Kind() {
+		case reflect.Slice, reflect.Array:
+			if _, err := strconv.Atoi(p); err == nil {
+				t = t.Elem()
+				continue
+			}
+			var ok bool
+			if t, ok = fieldType(t.Elem(), []string{p}); !ok {
+				return nil, false
+			}
+		case reflect.Map:
+			t = t.Elem()
+		case reflect.Struct:
+			sub, ok := structField(t, p)
+			if !ok {
+				return nil, false
+			}
+			t = sub
+		default:
+			return nil, false
+		}
+	}
+	return t, true
+}
+
+func structField(t reflect.Type, name string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		key, inline, skip := bsonKey(f)
+		if skip {
+			continue
+		}
+		if inline {
+			if ft, ok := fieldType(f.Type, []string{name}); ok {
+				return ft, true
+			}
+			continue
+		}
+		if key == name {
+			return f.Type, true
+		}
+	}
+	return nil, false
+}
+
+func bsonKey(f reflect.StructField) (key string, inline, skip bool) {
+	tag := f.Tag.Get("bson")
+	if tag == "-" {
+		return "", false, true
+	}
+	parts := strings.Split(tag, ",")
+	for _, o := range parts[1:] {
+		if o == "inline" {
+			inline = true
+		}
+	}
+	key = parts[0]
+	if key == "" {
+		key = strings.ToLower(f.Name)
+	}
+	return key, inline, false
+}
+
+func deref(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func elemType(t reflect.Type) reflect.Type {
+	t = deref(t)
+	if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		return t.Elem()
+	}
+	return nil
+}
+
+// isOpaque reports types whose inner layout is unknown: interfaces and
+// types with their own bson marshaling.
+func isOpaque(t reflect.Type) bool {
+	if t.Kind() == reflect.Interface {
+		return true
+	}
+	pt := reflect.PtrTo(t)
+	return t.Implements(bsonMarshaler) || t.Implements(bsonValueMarshaler) ||
+		pt.Implements(bsonMarshaler) || pt.Implements(bsonValueMarshaler)
+}
+
+func toEntries(v interface{}) (bson.D, bool) {
+	switch t := v.(type) {
+	case bson.D:
+		return t, true
+	case bson.M:
+		return D(t), true
+	case map[string]interface{}:
+		return D(t), true
+	}
+	return nil, false
+}
+
+func toList(v interface{}) ([]interface{}, bool) {
+	switch t := v.(type) {
+	case bson.A:
+		return t, true
+	case []interface{}:
+		return t, true
+	case []bson.M:
+		l := make([]interface{}, len(t))
+		for i, q := range t {
+			l[i] = q
+		}
+		return l, true
+	case []bson.D:
+		l := make([]interface{}, len(t))
+		for i, q := range t {
+			l[i] = q
+		}
+		return l, true
+	}
+	return nil, false
+}
@@ -0,0 +1,146 @@
+package morm
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Repo wraps MgoDBModel for a single DocInter type so reads return []T
+// instead of interface{}. T must be a pointer type, e.g. Repo[*User].
+type Repo[T DocInter] struct {
+	mm MgoDBModel
+}
+
+func NewRepo[T DocInter](mm MgoDBModel) *Repo[T] {
+	newTyped[T]()
+	return &Repo[T]{mm: mm}
+}
+
+func (r *Repo[T]) Model() MgoDBModel {
+	return r.mm
+}
+
+func (r *Repo[T]) New() T {
+	return newTyped[T]()
+}
+
+func (r *Repo[T]) FindOne(q bson.M, opts ...*options.FindOneOptions) (T, error) {
+	d := newTyped[T]()
+	if err := r.mm.FindOne(d, q, opts...); err != nil {
+		var zero T
+		return zero, err
+	}
+	return d, nil
+}
+
+func (r *Repo[T]) Find(q bson.M, opts ...*options.FindOptions) ([]T, error) {
+	result, err := r.mm.Find(newTyped[T](), q, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return toTypedSlice[T](result)
+}
+
+func (r *Repo[T]) PageFind(q bson.M, limit, page int64, opts ...*options.FindOptions) ([]T, error) {
+	result, err := r.mm.PageFind(newTyped[T](), q, limit, page, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return toTypedSlice[T](result)
+}
+
+func (r *Repo[T]) FindAndExec(q bson.M, exec func(d T) error, opts ...*options.FindOptions) error {
+	return r.mm.FindAndExec(newTyped[T](), q, func(i interface{}) error {
+		d, ok := i.(T)
+		if !ok {
+			return fmt.Errorf("unexpected doc type %T", i)
+		}
+		return exec(d)
+	}, opts...)
+}
+
+func (r *Repo[T]) CountDocuments(q bson.M, opts ...*options.CountOptions) (int64, error) {
+	return r.mm.CountDocuments(newTyped[T](), q, opts...)
+}
+
+// AggRepo is the MgoAggregate counterpart of Repo.
+type AggRepo[T MgoAggregate] struct {
+	mm MgoDBModel
+}
+
+func NewAggRepo[T MgoAggregate](mm MgoDBModel) *AggRepo[T] {
+	newTyped[T]()
+	return &AggRepo[T]{mm: mm}
+}
+
+func (r *AggRepo[T]) Model() MgoDBModel {
+	return r.mm
+}
+
+func (r *AggRepo[T]) New() T {
+	return newTyped[T]()
+}
+
+func (r *AggRepo[T]) PipeFindOne(q bson.M) (T, error) {
+	aggr := newTyped[T]()
+	if err := r.mm.PipeFindOne(aggr, q); err != nil {
+		var zero T
+		return zero, err
+	}
+	return aggr, nil
+}
+
+func (r *AggRepo[T]) PipeFind(q bson.M, opts ...*options.AggregateOptions) ([]T, error) {
+	result, err := r.mm.PipeFind(newTyped[T](), q, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return toTypedSlice[T](result)
+}
+
+func (r *AggRepo[T]) PagePipeFind(q bson.M, sort bson.M, limit, page int64, opts ...*options.AggregateOptions) ([]T, error) {
+	result, err := r.mm.PagePipeFind(newTyped[T](), q, sort, limit, page, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return toTypedSlice[T](result)
+}
+
+func (r *AggRepo[T]) PipeFindAndExec(q bson.M, exec func(aggr T) error, opts ...*options.AggregateOptions) error {
+	return r.mm.PipeFindAndExec(newTyped[T](), q, func(i interface{}) error {
+		aggr, ok := i.(T)
+		if !ok {
+			return fmt.Errorf("unexpected aggregate type %T", i)
+		}
+		return exec(aggr)
+	}, opts...)
+}
+
+func (r *AggRepo[T]) CountAggrDocuments(q bson.M, opts ...*options.AggregateOptions) (int64, error) {
+	return r.mm.CountAggrDocuments(newTyped[T](), q, opts...)
+}
+
+// newTyped allocates the struct T points to. It panics when T is not a
+// pointer type since the model decodes into reflect.New of the element.
+func newTyped[T any]() T {
+	var zero T
+	t := reflect.TypeOf(zero)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("repo type must be a pointer to struct, got %v", t))
+	}
+	return reflect.New(t.Elem()).Interface().(T)
+}
+
+func toTypedSlice[T any](result interface{}) ([]T, error) {
+	if result == nil {
+		return nil, nil
+	}
+	slice, ok := result.([]T)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type %T", result)
+	}
+	return slice, nil
+}
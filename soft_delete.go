@@ -0,0 +1,121 @@
+package morm
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrNotSoftDeleteDoc = errors.New("doc does not support soft delete")
+
+func (mm *mgoModelImpl) WithDeleted() MgoDBModel {
+	cp := *mm
+	cp.withDeleted = true
+	return &cp
+}
+
+// wrappedDoc is implemented by internal docs built around the one of the
+// caller, liveFilter looks through them.
+type wrappedDoc interface {
+	unwrap() interface{}
+}
+
+// liveFilter excludes soft deleted docs from q unless the model was built
+// with WithDeleted or q already filters on the deletion marker.
+func (mm *mgoModelImpl) liveFilter(d interface{}, q bson.M) bson.M {
+	if mm.withDeleted {
+		return q
+	}
+	if w, ok := d.(wrappedDoc); ok {
+		d = w.unwrap()
+	}
+	if _, ok := d.(SoftDeleteDoc); !ok {
+		return q
+	}
+	if _, ok := q[FieldDeletedAt]; ok {
+		return q
+	}
+	live := bson.M{FieldDeletedAt: nil}
+	for k, v := range q {
+		live[k] = v
+	}
+	return live
+}
+
+func (mm *mgoModelImpl) softRemove(d DocInter, q bson.M, u LogUser, multi bool) (int64, error) {
+	filter := bson.M{FieldDeletedAt: nil}
+	for k, v := range q {
+		filter[k] = v
+	}
+	now := time.Now()
+	set := bson.D{{Key: FieldDeletedAt, Value: now}}
+	update := bson.D{}
+	history := u != nil && isHistoryDoc(d)
+	if u != nil {
+		set = append(set, primitive.E{Key: FieldDeletedBy, Value: u.GetAccount()})
+	}
+	if u != nil && !history {
+		if err := mm.initRecords(d, filter); err != nil {
+			return 0, err
+		}
+		update = append(update, primitive.E{Key: "$push", Value: primitive.M{"records": NewRecord(now, u.GetAccount(), u.GetName(), "deleted")}})
+	}
+	update = append(bson.D{{Key: "$set", Value: set}}, update...)
+	var ids []interface{}
+	if history {
+		var err error
+		if ids, err = mm.findIDs(d, filter); err != nil {
+			return 0, err
+		}
+	}
+	n, err := mm.updateDocs(d, filter, update, multi)
+	if err == nil && history {
+		err = mm.writeHistory(d, newHistoryEntries(ids, u, HistoryDelete, "deleted"))
+	}
+	return n, err
+}
+
+func (mm *mgoModelImpl) Restore(d DocInter, u LogUser) (int64, error) {
+	if _, ok := d.(SoftDeleteDoc); !ok {
+		return 0, ErrNotSoftDeleteDoc
+	}
+	update := bson.D{
+		{Key: "$unset", Value: primitive.M{FieldDeletedAt: "", FieldDeletedBy: ""}},
+	}
+	filter := bson.M{"_id": d.GetID(), FieldDeletedAt: bson.M{"$ne": nil}}
+	history := u != nil && isHistoryDoc(d)
+	if u != nil && !history {
+		if err := mm.initRecords(d, filter); err != nil {
+			return 0, err
+		}
+		update = append(update, primitive.E{Key: "$push", Value: primitive.M{"records": NewRecord(time.Now(), u.GetAccount(), u.GetName(), "restored")}})
+	}
+	n, err := mm.updateDocs(d, filter, update, false)
+	if err == nil && history && n > 0 {
+		err = mm.writeHistory(d, newHistoryEntries([]interface{}{d.GetID()}, u, HistoryRestore, "restored"))
+	}
+	return n, err
+}
+
+// Purge permanently removes the docs matching q, soft deleted or not.
+func (mm *mgoModelImpl) Purge(d DocInter, q bson.M, u LogUser) (int64, error) {
+	return mm.hardRemove(d, q, u, true)
+}
+
+func (mm *mgoModelImpl) updateDocs(d DocInter, q bson.M, update bson.D, multi bool) (int64, error) {
+	collection := mm.db.Collection(d.GetC())
+	var result *mongo.UpdateResult
+	var err error
+	if multi {
+		result, err = collection.UpdateMany(mm.ctx, q, update)
+	} else {
+		result, err = collection.UpdateOne(mm.ctx, q, update)
+	}
+	if result != nil {
+		return result.ModifiedCount, err
+	}
+	return 0, err
+}
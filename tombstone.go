@@ -0,0 +1,183 @@
+package morm
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DeletedC is the deletion log collection of c. Hard removes made with a
+// LogUser leave a Tombstone there.
+func DeletedC(c string) string {
+	return c + "_deleted"
+}
+
+// Tombstone keeps a copy of a removed doc and who removed it.
+type Tombstone struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	DocID    interface{}        `bson:"docId"`
+	Doc      bson.D             `bson:"doc"`
+	Account  string             `bson:"account"`
+	Name     string             `bson:"name"`
+	Datetime time.Time          `bson:"datetime"`
+
+	c string
+}
+
+// NewTombstone returns an empty Tombstone bound to the deletion log of d,
+// usable with FindOne, Find and the pagination sources.
+func NewTombstone(d DocInter) *Tombstone {
+	return &Tombstone{c: DeletedC(d.GetC())}
+}
+
+// DecodeDoc decodes the removed doc into v.
+func (t *Tombstone) DecodeDoc(v interface{}) error {
+	raw, err := bson.Marshal(t.Doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, v)
+}
+
+func (t *Tombstone) GetC() string {
+	return t.c
+}
+
+func (t *Tombstone) GetID() interface{} {
+	return t.ID
+}
+
+func (t *Tombstone) GetDoc() interface{} {
+	return t
+}
+
+func (t *Tombstone) SetCreator(u LogUser) {}
+
+func (t *Tombstone) AddRecord(u LogUser, msg string) []*Record {
+	return nil
+}
+
+func (t *Tombstone) GetIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{Keys: bson.D{{Key: "docId", Value: 1}, {Key: "datetime", Value: -1}}},
+	}
+}
+
+// hardRemoveChunk is how many docs hardRemove deletes at a time.
+const hardRemoveChunk = 500
+
+// hardRemove deletes the docs matching q. With a user the docs are read
+// through a cursor and deleted in chunks, a tombstone is written for every
+// doc actually deleted, along with a delete entry in the history of a
+// HistoryDoc.
+func (mm *mgoModelImpl) hardRemove(d DocInter, q bson.M, u LogUser, multi bool) (int64, error) {
+	collection := mm.db.Collection(d.GetC())
+	if u == nil {
+		var result *mongo.DeleteResult
+		var err error
+		if multi {
+			result, err = collection.DeleteMany(mm.ctx, q)
+		} else {
+			result, err = collection.DeleteOne(mm.ctx, q)
+		}
+		if result != nil {
+			return result.DeletedCount, err
+		}
+		return 0, err
+	}
+	opts := options.Find()
+	if !multi {
+		opts.SetLimit(1)
+	}
+	cursor, err := collection.Find(mm.ctx, q, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(mm.ctx)
+	var deleted int64
+	var docs []bson.D
+	for cursor.Next(mm.ctx) {
+		var doc bson.D
+		if err = cursor.Decode(&doc); err != nil {
+			return deleted, err
+		}
+		if docs = append(docs, doc); len(docs) < hardRemoveChunk {
+			continue
+		}
+		n, err := mm.removeChunk(d, q, docs, u)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+		docs = nil
+	}
+	if err = cursor.Err(); err != nil {
+		return deleted, err
+	}
+	if len(docs) > 0 {
+		n, err := mm.removeChunk(d, q, docs, u)
+		return deleted + n, err
+	}
+	return deleted, nil
+}
+
+// removeChunk deletes docs, as long as they still match q, then writes the
+// tombstones and history entries of the ones it deleted.
+func (mm *mgoModelImpl) removeChunk(d DocInter, q bson.M, docs []bson.D, u LogUser) (int64, error) {
+	ids := make(primitive.A, len(docs))
+	for i, doc := range docs {
+		ids[i], _ = docGet(doc, "_id")
+	}
+	byID := bson.M{"_id": bson.M{"$in": ids}}
+	filter := byID
+	if len(q) > 0 {
+		filter = bson.M{"$and": bson.A{q, byID}}
+	}
+	result, err := mm.db.Collection(d.GetC()).DeleteMany(mm.ctx, filter)
+	if result == nil || err != nil {
+		return 0, err
+	}
+	if int(result.DeletedCount) < len(docs) {
+		// some docs were gone or no longer matched q, keep the ones deleted
+		left, err := mm.findIDs(d, byID)
+		if err != nil {
+			return result.DeletedCount, err
+		}
+		docs, ids = withoutDocs(docs, left)
+	}
+	if len(docs) == 0 {
+		return result.DeletedCount, nil
+	}
+	err = mm.writeTombstones(d, docs, u)
+	if err == nil && isHistoryDoc(d) {
+		err = mm.writeHistory(d, newHistoryEntries(ids, u, HistoryDelete, "deleted"))
+	}
+	return result.DeletedCount, err
+}
+
+func (mm *mgoModelImpl) writeTombstones(d DocInter, docs []bson.D, u LogUser) error {
+	proto := NewTombstone(d)
+	if !mm.disableCheckBeforeSave {
+		if err := mm.CreateCollection(proto); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	tombstones := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		id, _ := docGet(doc, "_id")
+		tombstones[i] = &Tombstone{
+			ID:       primitive.NewObjectID(),
+			DocID:    id,
+			Doc:      doc,
+			Account:  u.GetAccount(),
+			Name:     u.GetName(),
+			Datetime: now,
+		}
+	}
+	_, err := mm.db.Collection(proto.GetC()).InsertMany(mm.ctx, tombstones)
+	return err
+}
@@ -0,0 +1,106 @@
+package morm
+
+import (
+	"context"
+	"errors"
+
+	"github.com/wayne011872/morm/conn"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultTxRetries = 3
+
+	// error labels set by the server and the driver
+	labelTransientTransaction     = "TransientTransactionError"
+	labelUnknownTransactionCommit = "UnknownTransactionCommitResult"
+)
+
+type TxOptions struct {
+	// Retries is how many times the transaction runs again after a
+	// TransientTransactionError, and the commit after an
+	// UnknownTransactionCommitResult. 3 when zero, negative disables them.
+	Retries     int
+	Session     *options.SessionOptions
+	Transaction *options.TransactionOptions
+}
+
+func (o *TxOptions) retries() int {
+	if o == nil || o.Retries == 0 {
+		return defaultTxRetries
+	}
+	if o.Retries < 0 {
+		return 0
+	}
+	return o.Retries
+}
+
+// RunInTransaction runs f in a transaction on the MongoDBConn of ctx. The
+// model given to f is bound to the session, the transaction is committed
+// when f returns nil and aborted when it fails or panics. f may run more
+// than once so it should not have side effects outside the database.
+func RunInTransaction(ctx context.Context, f func(MgoDBModel) error, opts *TxOptions) error {
+	clt := conn.GetMgoDbConnFromCtx(ctx)
+	if clt == nil {
+		return errors.New("database not set in ctx")
+	}
+	var sessOpts *options.SessionOptions
+	var txOpts *options.TransactionOptions
+	if opts != nil {
+		sessOpts, txOpts = opts.Session, opts.Transaction
+	}
+	db := clt.GetDbConn()
+	session, err := db.Client().StartSession(sessOpts)
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	retries := opts.retries()
+	for attempt := 0; ; attempt++ {
+		err = runTransaction(ctx, session, db, f, txOpts, retries)
+		if err == nil {
+			return nil
+		}
+		if attempt >= retries || ctx.Err() != nil || !hasErrorLabel(err, labelTransientTransaction) {
+			return err
+		}
+	}
+}
+
+func runTransaction(
+	ctx context.Context, session mongo.Session, db *mongo.Database,
+	f func(MgoDBModel) error, txOpts *options.TransactionOptions, retries int,
+) error {
+	if err := session.StartTransaction(txOpts); err != nil {
+		return err
+	}
+	done := false
+	defer func() {
+		if !done {
+			// abort even when ctx is done, the deferred call also runs
+			// when f panics
+			session.AbortTransaction(context.Background())
+		}
+	}()
+	sc := mongo.NewSessionContext(ctx, session)
+	if err := f(NewMgoModel(sc, db)); err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err := session.CommitTransaction(sc)
+		if err == nil {
+			done = true
+			return nil
+		}
+		if attempt >= retries || ctx.Err() != nil || !hasErrorLabel(err, labelUnknownTransactionCommit) {
+			return err
+		}
+	}
+}
+
+func hasErrorLabel(err error, label string) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorLabel(label)
+}
@@ -0,0 +1,78 @@
+package morm
+
+import (
+	"errors"
+	"strings"
+)
+
+// Validator is detected on Save, Upsert, BatchSave and BatchUpdate, a doc
+// failing it is never sent to the database. UpdateOne and UpdateAll only
+// carry partial fields so they are not validated.
+type Validator interface {
+	Validate() error
+}
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (fe *FieldError) String() string {
+	if fe.Field == "" {
+		return fe.Message
+	}
+	return fe.Field + ": " + fe.Message
+}
+
+// ValidationError lists the field level problems of a doc. Validate may
+// return one directly, any other error is wrapped into one without a field.
+type ValidationError struct {
+	Errors []*FieldError
+
+	cause error
+}
+
+func (ve *ValidationError) Add(field, msg string) *ValidationError {
+	ve.Errors = append(ve.Errors, &FieldError{Field: field, Message: msg})
+	return ve
+}
+
+// Err returns nil when nothing was added so Validate can end with
+// `return ve.Err()`.
+func (ve *ValidationError) Err() error {
+	if ve == nil || len(ve.Errors) == 0 {
+		return nil
+	}
+	return ve
+}
+
+func (ve *ValidationError) Error() string {
+	msgs := make([]string, len(ve.Errors))
+	for i, fe := range ve.Errors {
+		msgs[i] = fe.String()
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+func (ve *ValidationError) Unwrap() error {
+	return ve.cause
+}
+
+func validateDoc(d interface{}) error {
+	v, ok := d.(Validator)
+	if !ok {
+		return nil
+	}
+	err := v.Validate()
+	if err == nil {
+		return nil
+	}
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return ve
+	}
+	return &ValidationError{
+		Errors: []*FieldError{{Message: err.Error()}},
+		cause:  err,
+	}
+}
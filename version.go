@@ -0,0 +1,127 @@
+package morm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrVersionConflict = errors.New("version conflict")
+
+// VersionConflictError is returned when a VersionDoc was changed by someone
+// else since it was read, errors.Is(err, ErrVersionConflict) reports true.
+type VersionConflictError struct {
+	C       string
+	ID      interface{}
+	Version int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict: %s %v is no longer at version %d", e.C, e.ID, e.Version)
+}
+
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+func (mm *mgoModelImpl) versionedUpdateOne(d DocInter, vd VersionDoc, fields bson.D, u LogUser) (int64, error) {
+	set := bson.D{}
+	for _, f := range fields {
+		if f.Key != FieldVersion {
+			set = append(set, f)
+		}
+	}
+	filter := versionFilter(d, vd)
+	var changes []*FieldChange
+	if u != nil {
+		var err error
+		if changes, err = mm.changesOf(d, set); err != nil {
+			return 0, err
+		}
+	}
+	update := bson.D{
+		{Key: "$inc", Value: bson.M{FieldVersion: 1}},
+	}
+	if len(set) > 0 {
+		update = append(bson.D{{Key: "$set", Value: set}}, update...)
+	}
+	// the record is pushed rather than taken from d.AddRecord so d is left
+	// as it was when the update conflicts
+	var record *Record
+	if u != nil && !isHistoryDoc(d) {
+		if err := mm.initRecords(d, filter); err != nil {
+			return 0, err
+		}
+		record = NewRecord(time.Now(), u.GetAccount(), u.GetName(), "updated")
+		record.Changes = changes
+		update = append(update, primitive.E{Key: "$push", Value: bson.M{"records": record}})
+	}
+	collection := mm.db.Collection(d.GetC())
+	result, err := collection.UpdateOne(mm.ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	if result.MatchedCount == 0 {
+		n, err := collection.CountDocuments(mm.ctx, bson.M{"_id": d.GetID()})
+		if err != nil || n == 0 {
+			return 0, err
+		}
+		return 0, &VersionConflictError{C: d.GetC(), ID: d.GetID(), Version: vd.GetVersion()}
+	}
+	vd.SetVersion(vd.GetVersion() + 1)
+	if record != nil {
+		if records := d.AddRecord(u, "updated"); len(records) > 0 {
+			*records[len(records)-1] = *record
+		}
+	}
+	if u != nil && isHistoryDoc(d) {
+		entries := newHistoryEntries([]interface{}{d.GetID()}, u, HistoryUpdate, "updated")
+		entries[0].Changes = changes
+		err = mm.writeHistory(d, entries)
+	}
+	return result.ModifiedCount, err
+}
+
+func (mm *mgoModelImpl) versionedUpsert(d DocInter, vd VersionDoc) (interface{}, error) {
+	doc, err := toBsonD(d.GetDoc())
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	set := bson.D{}
+	for _, e := range doc {
+		if e.Key != FieldVersion {
+			set = append(set, e)
+		}
+	}
+	collection := mm.db.Collection(d.GetC())
+	_, err = collection.UpdateOne(mm.ctx,
+		versionFilter(d, vd),
+		bson.D{
+			{Key: "$set", Value: set},
+			{Key: "$inc", Value: bson.M{FieldVersion: 1}},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return primitive.NilObjectID, &VersionConflictError{C: d.GetC(), ID: d.GetID(), Version: vd.GetVersion()}
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	vd.SetVersion(vd.GetVersion() + 1)
+	return d.GetID(), nil
+}
+
+// versionFilter matches d at the version of vd, version 0 also matching
+// docs written before they were versioned.
+func versionFilter(d DocInter, vd VersionDoc) bson.M {
+	if vd.GetVersion() == 0 {
+		return bson.M{"_id": d.GetID(), FieldVersion: bson.M{"$in": bson.A{0, nil}}}
+	}
+	return bson.M{"_id": d.GetID(), FieldVersion: vd.GetVersion()}
+}
@@ -0,0 +1,181 @@
+package morm
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SheetWriter writes spreadsheet rows. Numbers, bools and times keep their
+// type, nil leaves the cell empty and anything else is written as text,
+// so are NaN and infinite floats.
+type SheetWriter interface {
+	Write(cells []interface{}) error
+}
+
+// xlsxMaxRows is the row limit of a sheet, title included.
+const xlsxMaxRows = 1048576
+
+var ErrSheetFull = errors.New("xlsx sheet row limit reached")
+
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/><Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/></Types>`
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`
+	// style 1 formats date cells as yyyy-mm-dd hh:mm:ss
+	xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts><fonts count="1"><font><sz val="11"/><name val="Calibri"/></font></fonts><fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills><borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders><cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs><cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/></cellXfs></styleSheet>`
+	xlsxSheetHead = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetTail = `</sheetData></worksheet>`
+)
+
+// xlsxWriter streams a single sheet workbook. Strings are written inline so
+// nothing has to be kept in memory between rows.
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	row   int
+}
+
+func newXLSXWriter(w io.Writer) (*xlsxWriter, error) {
+	zw := zip.NewWriter(w)
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, p := range parts {
+		pw, err := zw.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.WriteString(pw, p.body); err != nil {
+			return nil, err
+		}
+	}
+	sw, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	xw := &xlsxWriter{zw: zw, sheet: bufio.NewWriter(sw)}
+	_, err = xw.sheet.WriteString(xlsxSheetHead)
+	return xw, err
+}
+
+func (xw *xlsxWriter) Write(cells []interface{}) error {
+	if xw.row >= xlsxMaxRows {
+		return ErrSheetFull
+	}
+	xw.row++
+	fmt.Fprintf(xw.sheet, `<row r="%d">`, xw.row)
+	for i, c := range cells {
+		ref := xlsxColumn(i) + strconv.Itoa(xw.row)
+		if err := xw.writeCell(ref, c); err != nil {
+			return err
+		}
+	}
+	_, err := xw.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (xw *xlsxWriter) writeCell(ref string, v interface{}) error {
+	var err error
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case *time.Time:
+		if t == nil {
+			return nil
+		}
+		return xw.writeCell(ref, *t)
+	case time.Time:
+		_, err = fmt.Fprintf(xw.sheet, `<c r="%s" s="1"><v>%s</v></c>`, ref, strconv.FormatFloat(xlsxSerial(t), 'f', -1, 64))
+	case bool:
+		b := 0
+		if t {
+			b = 1
+		}
+		_, err = fmt.Fprintf(xw.sheet, `<c r="%s" t="b"><v>%d</v></c>`, ref, b)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		_, err = fmt.Fprintf(xw.sheet, `<c r="%s"><v>%d</v></c>`, ref, t)
+	case float32:
+		if math.IsNaN(float64(t)) || math.IsInf(float64(t), 0) {
+			return xw.writeCell(ref, strconv.FormatFloat(float64(t), 'g', -1, 32))
+		}
+		_, err = fmt.Fprintf(xw.sheet, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(float64(t), 'g', -1, 32))
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return xw.writeCell(ref, strconv.FormatFloat(t, 'g', -1, 64))
+		}
+		_, err = fmt.Fprintf(xw.sheet, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(t, 'g', -1, 64))
+	default:
+		s, ok := v.(string)
+		if !ok {
+			s = fmt.Sprint(v)
+		}
+		if _, err = fmt.Fprintf(xw.sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref); err != nil {
+			return err
+		}
+		if err = xml.EscapeText(xw.sheet, []byte(strings.Map(xmlChar, s))); err != nil {
+			return err
+		}
+		_, err = xw.sheet.WriteString(`</t></is></c>`)
+	}
+	return err
+}
+
+func (xw *xlsxWriter) Close() error {
+	if _, err := xw.sheet.WriteString(xlsxSheetTail); err != nil {
+		return err
+	}
+	if err := xw.sheet.Flush(); err != nil {
+		return err
+	}
+	return xw.zw.Close()
+}
+
+// xmlChar drops the runes XML 1.0 does not allow, mostly control
+// characters, xml.EscapeText would turn them into U+FFFD.
+func xmlChar(r rune) rune {
+	switch {
+	case r == '\t' || r == '\n' || r == '\r',
+		r >= 0x20 && r <= 0xD7FF,
+		r >= 0xE000 && r <= 0xFFFD,
+		r >= 0x10000 && r <= 0x10FFFF:
+		return r
+	}
+	return -1
+}
+
+// xlsxColumn returns the column letters of the zero based index i.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+var xlsxEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// xlsxSerial converts t to the spreadsheet day count, keeping its wall
+// clock.
+func xlsxSerial(t time.Time) float64 {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	return wall.Sub(xlsxEpoch).Hours() / 24
+}